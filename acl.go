@@ -0,0 +1,107 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"path"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ACLConfig is the access control section of Config.  Roles maps a role name to the "module.method"
+// patterns it grants and Clients maps a client ID to the roles and patterns granted to it.  Clients
+// that are not listed get Default.  Patterns are matched like file names, so "garage_doors.*" grants
+// every method of garage_doors and "*" grants everything.
+type ACLConfig struct {
+	Roles   map[string][]string
+	Clients map[string][]string
+	Default []string
+}
+
+// ACL decides which module methods each client may call.  A nil ACL allows everything.
+type ACL struct {
+	clients  map[uuid.UUID][]string
+	defaults []string
+}
+
+// NewACL expands the roles in config into the patterns each client is granted.  A nil config yields a
+// nil ACL.
+func NewACL(config *ACLConfig) (*ACL, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	acl := &ACL{clients: make(map[uuid.UUID][]string, len(config.Clients))}
+
+	var err error
+	if acl.defaults, err = config.expand(config.Default); err != nil {
+		return nil, err
+	}
+
+	for rawID, grants := range config.Clients {
+		id, err := uuid.FromString(rawID)
+		if err != nil {
+			return nil, err
+		}
+
+		if acl.clients[id], err = config.expand(grants); err != nil {
+			return nil, err
+		}
+	}
+	return acl, nil
+}
+
+// expand replaces role names in grants with the patterns of the roles and checks every pattern.
+func (c *ACLConfig) expand(grants []string) ([]string, error) {
+	patterns := []string{}
+	for _, grant := range grants {
+		if rolePatterns, ok := c.Roles[grant]; ok {
+			patterns = append(patterns, rolePatterns...)
+		} else {
+			patterns = append(patterns, grant)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return patterns, nil
+}
+
+// Allowed reports whether sender may call method on module.
+func (a *ACL) Allowed(sender *uuid.UUID, module, method string) bool {
+	if a == nil {
+		return true
+	}
+
+	patterns := a.defaults
+	if sender != nil {
+		if granted, ok := a.clients[*sender]; ok {
+			patterns = granted
+		}
+	}
+
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, module+"."+method); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestACLAllowed(t *testing.T) {
+	admin, family, stranger := uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	acl, err := NewACL(&ACLConfig{
+		Roles: map[string][]string{
+			"admin":  {"*"},
+			"family": {"garage_doors.*", "igor.catalog"},
+		},
+		Clients: map[string][]string{
+			admin.String():  {"admin"},
+			family.String(): {"family", "lights.On"},
+		},
+		Default: []string{"igor.catalog"},
+	})
+	if err != nil {
+		t.Fatalf("NewACL: %v", err)
+	}
+
+	for _, test := range []struct {
+		name           string
+		acl            *ACL
+		sender         *uuid.UUID
+		module, method string
+		allowed        bool
+	}{
+		{"no ACL", nil, &stranger, "garage_doors", "Trigger", true},
+		{"role granting everything", acl, &admin, "igor", "ban", true},
+		{"role pattern", acl, &family, "garage_doors", "Trigger", true},
+		{"pattern granted directly", acl, &family, "lights", "On", true},
+		{"method not granted", acl, &family, "lights", "Off", false},
+		{"built-in not granted", acl, &family, "igor", "ban", false},
+		{"unlisted client gets the default", acl, &stranger, "igor", "catalog", true},
+		{"unlisted client", acl, &stranger, "garage_doors", "Trigger", false},
+		{"no sender gets the default", acl, nil, "igor", "catalog", true},
+	} {
+		if allowed := test.acl.Allowed(test.sender, test.module, test.method); allowed != test.allowed {
+			t.Errorf("%s: got %t, want %t", test.name, allowed, test.allowed)
+		}
+	}
+}
+
+func TestNewACLRejectsBadConfig(t *testing.T) {
+	for name, config := range map[string]*ACLConfig{
+		"bad pattern":   {Default: []string{"garage_doors.["}},
+		"bad client ID": {Clients: map[string][]string{"phone": {"*"}}},
+	} {
+		if _, err := NewACL(config); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
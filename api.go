@@ -0,0 +1,221 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/websocket"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+const (
+	// SenderHeader and SignatureHeader authenticate a local API request.  The signature covers the
+	// request body and is made with the same key the client signs its envelopes with.
+	SenderHeader    = "X-Igor-Sender"
+	SignatureHeader = "X-Igor-Signature"
+	// TimestampHeader (RFC 3339) takes the place of the body when opening the events websocket.
+	TimestampHeader = "X-Igor-Timestamp"
+
+	RequestsPath = "/requests"
+	EventsPath   = "/events"
+
+	maxRequestSize = 1048576
+)
+
+// ServeAPI starts serving the local HTTPS API on config.APIAddress.  Requests it accepts go through
+// the same dispatch path as the ones arriving from the relay server.
+func (g *Gateway) ServeAPI() error {
+	config := g.Config()
+
+	listener, err := net.Listen("tcp", config.APIAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(RequestsPath, g.handleRequest)
+	mux.Handle(EventsPath, websocket.Server{Handshake: g.authorizeListener, Handler: g.handleListener})
+
+	g.api = &http.Server{Handler: mux}
+	go func() {
+		err := g.api.ServeTLS(listener, config.APICertfile, config.APIKeyfile)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Errorln("Local API server stopped.")
+		}
+	}()
+
+	log.WithField("address", config.APIAddress).Debugln("Serving local API.")
+	return nil
+}
+
+func (g *Gateway) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, "Could not read request.", http.StatusBadRequest)
+		return
+	}
+
+	host := remoteHost(r)
+	if g.bans.Banned(host) || g.bans.Banned(r.Header.Get(SenderHeader)) {
+		http.Error(w, "Sender is banned.", http.StatusForbidden)
+		return
+	}
+
+	sender, err := uuid.FromString(r.Header.Get(SenderHeader))
+	if err == nil {
+		err = g.senders.VerifySignature(&sender, string(body), r.Header.Get(SignatureHeader))
+	}
+	if err != nil {
+		if g.unverifiedLimit.Allow(unverifiedKey) {
+			log.WithFields(log.Fields{
+				"sender":  r.Header.Get(SenderHeader),
+				"address": r.RemoteAddr,
+				"error":   err,
+			}).Warningln("Rejected local API request from unverified sender.")
+			g.audit.Rejected(r.Header.Get(SenderHeader))
+		}
+
+		// the sender header is unverified, the address it came from is not
+		if err != ErrUnknownSender && sender != uuid.Nil {
+			g.bans.Failure(host)
+		}
+		http.Error(w, "Sender could not be verified.", http.StatusUnauthorized)
+		return
+	}
+
+	if !g.senderLimit.Allow(sender.String()) {
+		http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+		return
+	}
+
+	req := new(models.Request)
+	if err := json.Unmarshal(body, req); err != nil {
+		writeResponse(w, models.NewErrorResponse("", "", models.ErrorDecode, "Could not parse the request."))
+		return
+	}
+
+	if !g.begin() {
+		resp := models.NewErrorResponse(req.Module, req.Method, models.ErrorUnavailable, "Igor is shutting down.")
+		g.audit.Record(&sender, req, resp, 0)
+		writeResponse(w, resp)
+		return
+	}
+	defer g.inFlight.Done()
+
+	writeResponse(w, g.dispatch(&sender, req))
+}
+
+// remoteHost identifies the client at the other end of r in the ban list.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeResponse(w http.ResponseWriter, resp *models.Response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.WithError(err).Errorln("Could not marshal local API response.")
+		http.Error(w, "Could not marshal the response.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// authorizeListener only lets approved senders open the events websocket.
+func (g *Gateway) authorizeListener(config *websocket.Config, r *http.Request) error {
+	if g.bans.Banned(remoteHost(r)) || g.bans.Banned(r.Header.Get(SenderHeader)) {
+		return ErrBanned
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, r.Header.Get(TimestampHeader))
+	if err != nil {
+		return err
+	} else if !g.replays.Fresh(timestamp) {
+		return ErrStaleRequest
+	}
+
+	sender, err := uuid.FromString(r.Header.Get(SenderHeader))
+	if err == nil {
+		err = g.senders.VerifySignature(&sender, r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sender":  r.Header.Get(SenderHeader),
+			"address": r.RemoteAddr,
+			"error":   err,
+		}).Warningln("Rejected event listener from unverified sender.")
+	}
+	return err
+}
+
+// handleListener receives every broadcast event until the client closes the websocket.
+func (g *Gateway) handleListener(ws *websocket.Conn) {
+	sender, _ := uuid.FromString(ws.Request().Header.Get(SenderHeader))
+
+	g.lock.Lock()
+	g.listeners[ws] = &sender
+	g.lock.Unlock()
+	log.WithField("sender", sender).Debugln("Event listener connected.")
+
+	// nothing is expected from the client, reading just notices when it goes away
+	io.Copy(ioutil.Discard, ws)
+
+	g.lock.Lock()
+	delete(g.listeners, ws)
+	g.lock.Unlock()
+	log.WithField("sender", sender).Debugln("Event listener disconnected.")
+}
+
+func (g *Gateway) notifyListeners(event *models.Response) {
+	g.lock.Lock()
+	listeners := make(map[*websocket.Conn]*uuid.UUID, len(g.listeners))
+	for ws, sender := range g.listeners {
+		listeners[ws] = sender
+	}
+	g.lock.Unlock()
+
+	for ws, sender := range listeners {
+		if err := websocket.JSON.Send(ws, event); err != nil {
+			log.WithFields(log.Fields{
+				"sender": sender,
+				"error":  err,
+			}).Debugln("Could not send event to listener.")
+			ws.Close()
+		}
+	}
+}
@@ -0,0 +1,550 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+const (
+	DefaultAuditMaxSize  = 10 * 1024 * 1024
+	DefaultAuditMaxFiles = 5
+	DefaultAuditLimit    = 100
+
+	// OutcomeSuccess is the outcome of a successful request, failures are recorded with their error code.
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeUnverified is the outcome of a request rejected because its signature did not check out.
+	OutcomeUnverified = "unverified"
+
+	// AuditHeadSuffix is appended to the audit log's name to name its head when no AuditHeadfile is
+	// configured.
+	AuditHeadSuffix = ".head"
+)
+
+var (
+	ErrAuditHeadMissing   = errors.New("The audit log has records but its head is missing, it was deleted.")
+	ErrAuditHeadSignature = errors.New("The audit log head is not signed by the device key.")
+)
+
+// AuditRecord is a single line of the audit log.  Hash covers the record itself and Prev, the hash of
+// the record before it, so changing, removing or reordering records breaks the chain.  Anyone can
+// recompute the chain, it is the signed AuditHead that ties it to igor.
+type AuditRecord struct {
+	Seq        uint64
+	Time       time.Time
+	Sender     string
+	Module     string
+	Method     string
+	ArgsDigest string
+	Outcome    string
+	Latency    time.Duration
+	Prev       string
+	Hash       string `json:",omitempty"`
+}
+
+// digest returns the hash of r as it is stored, without its own Hash.
+func (r AuditRecord) digest() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditHead is the newest record of the audit log signed with the device key.  It is kept in a file of
+// its own, so rewriting the log means forging the signature and truncating or deleting the log leaves
+// the head pointing at a record that is gone.
+type AuditHead struct {
+	Seq       uint64
+	Hash      string
+	Signature string
+}
+
+// signed returns what the head's signature covers.
+func (h *AuditHead) signed() []byte {
+	sum := sha256.Sum256([]byte("igor audit head " + strconv.FormatUint(h.Seq, 10) + " " + h.Hash))
+	return sum[:]
+}
+
+func (h *AuditHead) sign(key *DeviceKey) error {
+	sig, err := ecdsa.SignASN1(rand.Reader, key.private, h.signed())
+	if err != nil {
+		return err
+	}
+	h.Signature = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
+
+func (h *AuditHead) verify(key *ecdsa.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(h.Signature)
+	if err != nil || !ecdsa.VerifyASN1(key, h.signed(), sig) {
+		return ErrAuditHeadSignature
+	}
+	return nil
+}
+
+// ReadAuditHead reads the head of the audit log stored in filename, it returns nil if there is none
+// yet.
+func ReadAuditHead(filename string) (*AuditHead, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	head := new(AuditHead)
+	if err := json.Unmarshal(data, head); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// AuditLog appends an AuditRecord for every request handled to a file that is rotated once it
+// reaches maxSize, keeping maxFiles old files.  The hash chain continues across rotations and its head
+// is signed with the device key after every record.  A nil AuditLog records nothing.
+type AuditLog struct {
+	filename string
+	headfile string
+	key      *DeviceKey
+	maxSize  int64
+	maxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+	seq  uint64
+	last string
+}
+
+// OpenAuditLog opens filename for appending, picking the hash chain up from the last record written.
+// The head signed with key is kept in headfile.  It fails if the head does not match the log, run
+// VerifyAudit to find out what happened to it.
+func OpenAuditLog(filename, headfile string, key *DeviceKey, maxSize int64, maxFiles int) (*AuditLog, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultAuditMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultAuditMaxFiles
+	}
+
+	a := &AuditLog{filename: filename, headfile: headfile, key: key, maxSize: maxSize, maxFiles: maxFiles}
+
+	head, err := ReadAuditHead(headfile)
+	if err != nil {
+		return nil, err
+	} else if head != nil {
+		if err := head.verify(key.PublicKey()); err != nil {
+			return nil, err
+		}
+	}
+
+	// the newest records are in the current file unless it was just rotated
+	files := AuditFiles(filename, maxFiles)
+	var last, headRecord *AuditRecord
+	for i := len(files) - 1; i >= 0 && (last == nil || head != nil && headRecord == nil); i-- {
+		err := readAuditFile(files[i], func(line int, record AuditRecord) (bool, error) {
+			if last == nil || record.Seq > last.Seq {
+				last = &record
+			}
+			if head != nil && record.Seq == head.Seq {
+				headRecord = &record
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case head == nil && last != nil:
+		return nil, ErrAuditHeadMissing
+	case head != nil && (headRecord == nil || headRecord.Hash != head.Hash):
+		return nil, fmt.Errorf("The audit log does not contain record %d its head points to, it was truncated or rewritten.", head.Seq)
+	case head != nil && last.Seq > head.Seq:
+		// igor stops between writing a record and signing the head at worst, the next record covers it
+		log.WithFields(log.Fields{
+			"fileName": filename,
+			"head":     head.Seq,
+			"last":     last.Seq,
+		}).Warnln("The audit log has records its head does not cover.")
+	}
+
+	if last != nil {
+		a.seq, a.last = last.Seq, last.Hash
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file, a.size = file, info.Size()
+	return nil
+}
+
+// Record appends what happened to req.  Failing to write the audit log does not fail the request, it
+// is logged instead.
+func (a *AuditLog) Record(sender *uuid.UUID, req *models.Request, resp *models.Response, latency time.Duration) {
+	if a == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:       time.Now().UTC(),
+		Module:     req.Module,
+		Method:     req.Method,
+		ArgsDigest: argsDigest(req.Args),
+		Outcome:    outcome(resp),
+		Latency:    latency,
+	}
+	if sender != nil {
+		record.Sender = sender.String()
+	}
+
+	if err := a.append(record); err != nil {
+		log.WithFields(log.Fields{
+			"fileName": a.filename,
+			"error":    err,
+		}).Errorln("Could not write to the audit log.")
+	}
+}
+
+// Rejected records a request whose signature did not check out, sender is whoever it claimed to be
+// from and its contents were never read.
+func (a *AuditLog) Rejected(sender string) {
+	if a == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:    time.Now().UTC(),
+		Sender:  sender,
+		Outcome: OutcomeUnverified,
+	}
+	if err := a.append(record); err != nil {
+		log.WithFields(log.Fields{
+			"fileName": a.filename,
+			"error":    err,
+		}).Errorln("Could not write to the audit log.")
+	}
+}
+
+func (a *AuditLog) append(record AuditRecord) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	record.Seq, record.Prev = a.seq+1, a.last
+
+	var err error
+	if record.Hash, err = record.digest(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	n, err := a.file.Write(append(data, '\n'))
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	a.seq, a.last = record.Seq, record.Hash
+
+	if err := a.writeHead(); err != nil {
+		return err
+	}
+	if a.size >= a.maxSize {
+		return a.rotate()
+	}
+	return nil
+}
+
+// writeHead signs the last record written and replaces the head with it.
+func (a *AuditLog) writeHead() error {
+	head := &AuditHead{Seq: a.seq, Hash: a.last}
+	if err := head.sign(a.key); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.headfile, data, 0600)
+}
+
+// rotate moves the current file to filename.1, shifting older files up and dropping the oldest.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(rotatedAuditFile(a.filename, a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedAuditFile(a.filename, i), rotatedAuditFile(a.filename, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.filename, rotatedAuditFile(a.filename, 1)); err != nil {
+		return err
+	}
+
+	log.WithField("fileName", a.filename).Infoln("Rotated audit log.")
+	return a.open()
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+func rotatedAuditFile(filename string, i int) string {
+	return filename + "." + strconv.Itoa(i)
+}
+
+// AuditFiles lists the audit log files that exist for filename, oldest first.
+func AuditFiles(filename string, maxFiles int) []string {
+	if maxFiles <= 0 {
+		maxFiles = DefaultAuditMaxFiles
+	}
+
+	files := []string{}
+	for i := maxFiles; i >= 1; i-- {
+		if _, err := os.Stat(rotatedAuditFile(filename, i)); err == nil {
+			files = append(files, rotatedAuditFile(filename, i))
+		}
+	}
+	if _, err := os.Stat(filename); err == nil {
+		files = append(files, filename)
+	}
+	return files
+}
+
+func argsDigest(args json.RawMessage) string {
+	sum := sha256.Sum256(args)
+	return hex.EncodeToString(sum[:])
+}
+
+func outcome(resp *models.Response) string {
+	if resp.Success {
+		return OutcomeSuccess
+	} else if code, ok := resp.Data["code"].(string); ok {
+		return code
+	}
+	return OutcomeFailure
+}
+
+// readAuditFile calls fn with every record in filename along with its line number until fn returns
+// false.
+func readAuditFile(filename string, fn func(line int, record AuditRecord) (bool, error)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return readAuditRecords(file, filename, fn)
+}
+
+// readAuditRecords is readAuditFile for records read from r, filename names r in errors.
+func readAuditRecords(r io.Reader, filename string, fn func(line int, record AuditRecord) (bool, error)) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		record := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("%s:%d: Record could not be parsed: %s", filename, line, err)
+		}
+
+		if more, err := fn(line, record); err != nil || !more {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// VerifyAudit checks the hash chain through files, oldest first, and that it ends in head, which has to
+// be signed by the device key whose public half is key.  It returns how many records it checked.  The
+// first record's Prev cannot be checked when older files were rotated away.
+func VerifyAudit(files []string, head *AuditHead, key *ecdsa.PublicKey) (int, error) {
+	count := 0
+	var prev *AuditRecord
+
+	if head != nil {
+		if err := head.verify(key); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, filename := range files {
+		err := readAuditFile(filename, func(line int, record AuditRecord) (bool, error) {
+			hash, err := record.digest()
+			if err != nil {
+				return false, err
+			} else if hash != record.Hash {
+				return false, fmt.Errorf("%s:%d: Record %d does not match its hash, it was changed.", filename, line, record.Seq)
+			}
+
+			if prev != nil && (record.Prev != prev.Hash || record.Seq != prev.Seq+1) {
+				return false, fmt.Errorf("%s:%d: Record %d does not follow record %d, records were removed or reordered.", filename, line, record.Seq, prev.Seq)
+			}
+
+			prev = &record
+			count++
+			return true, nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+
+	switch {
+	case head == nil && prev != nil:
+		return count, ErrAuditHeadMissing
+	case head == nil:
+	case prev == nil || prev.Seq < head.Seq:
+		return count, fmt.Errorf("The audit log ends before record %d its head points to, it was truncated.", head.Seq)
+	case prev.Seq > head.Seq:
+		return count, fmt.Errorf("Records after %d are not covered by the audit log head, they were added by someone else or igor stopped while writing them.", head.Seq)
+	case prev.Hash != head.Hash:
+		return count, fmt.Errorf("Record %d does not match the audit log head, it was rewritten.", head.Seq)
+	}
+	return count, nil
+}
+
+// AuditQuery selects records from the audit log.  Zero fields match everything and at most Limit of
+// the newest matching records are returned.
+type AuditQuery struct {
+	Since, Until   time.Time
+	Sender         string
+	Module, Method string
+	Outcome        string
+	Limit          int
+}
+
+func (q *AuditQuery) matches(record AuditRecord) bool {
+	return (q.Since.IsZero() || !record.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || record.Time.Before(q.Until)) &&
+		(q.Sender == "" || q.Sender == record.Sender) &&
+		(q.Module == "" || q.Module == record.Module) &&
+		(q.Method == "" || q.Method == record.Method) &&
+		(q.Outcome == "" || q.Outcome == record.Outcome)
+}
+
+// Query returns the records matching query, oldest first.
+func (a *AuditLog) Query(query AuditQuery) ([]AuditRecord, error) {
+	if query.Limit <= 0 {
+		query.Limit = DefaultAuditLimit
+	}
+
+	files, size, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+
+	records := []AuditRecord{}
+	for _, file := range files {
+		var r io.Reader = file
+		if file.Name() == a.filename {
+			r = io.LimitReader(file, size)
+		}
+
+		err := readAuditRecords(r, file.Name(), func(line int, record AuditRecord) (bool, error) {
+			if query.matches(record) {
+				records = append(records, record)
+				if len(records) > query.Limit {
+					records = records[1:]
+				}
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// snapshot opens every file of the audit log, oldest first, so they can be read without holding the
+// lock.  Open files are not affected by rotation.  Only size bytes of the current file are complete
+// records, anything after that is still being appended.
+func (a *AuditLog) snapshot() ([]*os.File, int64, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	files := []*os.File{}
+	for _, filename := range AuditFiles(a.filename, a.maxFiles) {
+		file, err := os.Open(filename)
+		if err != nil {
+			closeFiles(files)
+			return nil, 0, err
+		}
+		files = append(files, file)
+	}
+	return files, a.size, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
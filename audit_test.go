@@ -0,0 +1,136 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+const auditTestRecords = 5
+
+// writeAuditLog records auditTestRecords requests in a new audit log in dir and returns its files.
+func writeAuditLog(t *testing.T, dir string, device *DeviceKey, maxSize int64) []string {
+	audit, err := OpenAuditLog(dir+"audit.log", dir+"audit.head", device, maxSize, 10)
+	if err != nil {
+		t.Fatalf("OpenAuditLog: %v", err)
+	}
+	defer audit.Close()
+
+	for i := 0; i < auditTestRecords; i++ {
+		req := &models.Request{Module: "garage_doors", Method: "Trigger", Args: []byte(`{"door":"left"}`)}
+		audit.Record(nil, req, models.NewResponse("garage_doors"), time.Millisecond)
+	}
+	return AuditFiles(dir+"audit.log", 10)
+}
+
+// editAuditLog replaces the lines of filename with what edit returns.
+func editAuditLog(t *testing.T, filename string, edit func(lines [][]byte) [][]byte) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	lines := edit(bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")))
+	data = bytes.Join(lines, []byte("\n"))
+	if len(data) > 0 {
+		data = append(data, '\n')
+	}
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	device, err := LoadOrGenerateDeviceKey(t.TempDir() + "/device.key")
+	if err != nil {
+		t.Fatalf("LoadOrGenerateDeviceKey: %v", err)
+	}
+	other, err := LoadOrGenerateDeviceKey(t.TempDir() + "/device.key")
+	if err != nil {
+		t.Fatalf("LoadOrGenerateDeviceKey: %v", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		maxSize int64
+		tamper  func(t *testing.T, dir string, files []string)
+		key     *DeviceKey
+		count   int
+		ok      bool
+	}{
+		{name: "intact", count: auditTestRecords, ok: true},
+		{name: "intact across rotations", maxSize: 300, count: auditTestRecords, ok: true},
+		{name: "record changed", tamper: func(t *testing.T, dir string, files []string) {
+			editAuditLog(t, files[0], func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte(`"Method":"Trigger"`), []byte(`"Method":"Status"`), 1)
+				return lines
+			})
+		}, count: 1},
+		{name: "record removed", tamper: func(t *testing.T, dir string, files []string) {
+			editAuditLog(t, files[0], func(lines [][]byte) [][]byte {
+				return append(lines[:2], lines[3:]...)
+			})
+		}, count: 2},
+		{name: "records reordered", tamper: func(t *testing.T, dir string, files []string) {
+			editAuditLog(t, files[0], func(lines [][]byte) [][]byte {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			})
+		}, count: 1},
+		{name: "truncated", tamper: func(t *testing.T, dir string, files []string) {
+			editAuditLog(t, files[0], func(lines [][]byte) [][]byte {
+				return lines[:len(lines)-1]
+			})
+		}, count: auditTestRecords - 1},
+		{name: "newest rotated file deleted", maxSize: 300, tamper: func(t *testing.T, dir string, files []string) {
+			// every record is bigger than maxSize so each one was rotated into a file of its own
+			os.Remove(rotatedAuditFile(dir+"audit.log", 1))
+		}, count: auditTestRecords - 1},
+		{name: "head deleted", tamper: func(t *testing.T, dir string, files []string) {
+			os.Remove(dir + "audit.head")
+		}, count: auditTestRecords},
+		{name: "head signed by another key", key: other, count: 0},
+	} {
+		dir := t.TempDir() + string(os.PathSeparator)
+		files := writeAuditLog(t, dir, device, test.maxSize)
+		if test.tamper != nil {
+			test.tamper(t, dir, files)
+			files = AuditFiles(dir+"audit.log", 10)
+		}
+
+		key := device
+		if test.key != nil {
+			key = test.key
+		}
+		head, err := ReadAuditHead(dir + "audit.head")
+		if err != nil {
+			t.Fatalf("%s: ReadAuditHead: %v", test.name, err)
+		}
+
+		count, err := VerifyAudit(files, head, key.PublicKey())
+		if (err == nil) != test.ok || count != test.count {
+			t.Errorf("%s: got %d records and %v, want %d records and ok %t", test.name, count, err, test.count, test.ok)
+		}
+	}
+}
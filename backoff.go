@@ -0,0 +1,58 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = time.Minute
+)
+
+// Backoff hands out exponentially growing, jittered delays between reconnection attempts.  It is not
+// safe for concurrent use.
+type Backoff struct {
+	Min, Max time.Duration
+	attempt  uint
+}
+
+func NewBackoff() *Backoff {
+	return &Backoff{Min: DefaultMinBackoff, Max: DefaultMaxBackoff}
+}
+
+// Next returns how long to wait before the next attempt.  The delay doubles with every call, up to Max,
+// and is randomized to within half of that so a fleet of clients does not reconnect in lockstep.
+func (b *Backoff) Next() time.Duration {
+	delay := b.Min << b.attempt
+	if delay > b.Max || delay <= 0 {
+		delay = b.Max
+	} else {
+		b.attempt++
+	}
+
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Reset starts the delays over from Min, call it once a connection is established.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
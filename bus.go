@@ -0,0 +1,295 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	sModels "github.com/alittlebrighter/switchboard/models"
+	"github.com/nats-io/nats"
+)
+
+const (
+	BrokerNATS  = "nats"
+	BrokerLocal = "local"
+
+	localInboxPrefix = "_INBOX."
+
+	natsReconnectWait = 2 * time.Second
+)
+
+var (
+	ErrBusClosed      = errors.New("Message bus is closed.")
+	ErrRequestTimeout = errors.New("Request timed out.")
+	ErrConnectTimeout = errors.New("Timed out connecting to the message broker.")
+)
+
+// EnvelopeHandler processes an envelope received on subject.  If the sender expects an answer reply
+// holds the subject the answer should be published to.
+type EnvelopeHandler func(subject, reply string, env *sModels.Envelope)
+
+// BusSubscription is a handle on an active subscription to a MessageBus subject.
+type BusSubscription interface {
+	Unsubscribe() error
+}
+
+// MessageBus carries envelopes between the gateway and the module subscriptions so igor does not
+// depend on a specific broker.
+type MessageBus interface {
+	Subscribe(subject string, handler EnvelopeHandler) (BusSubscription, error)
+	Request(subject string, env, response *sModels.Envelope, timeout time.Duration) error
+	Publish(subject string, env *sModels.Envelope) error
+	// Connected reports whether the bus can currently deliver envelopes.
+	Connected() bool
+	Close()
+}
+
+// NewMessageBus returns the MessageBus implementation selected by config.Broker.  NATS is used
+// when no broker is specified.  Connecting to the broker is retried until it succeeds unless timeout
+// is positive.
+func NewMessageBus(config *Config, timeout time.Duration) (MessageBus, error) {
+	switch config.Broker {
+	case BrokerLocal:
+		return NewLocalBus(), nil
+	case BrokerNATS, "":
+		return NewNATSBus(config.PrivateRelay, timeout)
+	default:
+		return nil, errors.New("Unknown broker: " + config.Broker)
+	}
+}
+
+// NATSBus is a MessageBus backed by a gnatsd server.
+type NATSBus struct {
+	conn *nats.EncodedConn
+}
+
+// NewNATSBus connects to the gnatsd server at host, retrying with backoff until it succeeds or, if
+// timeout is positive, until timeout has passed.  Once connected the NATS client reconnects on its own
+// and restores every subscription when it does.
+func NewNATSBus(host string, timeout time.Duration) (*NATSBus, error) {
+	log := logger.WithFields(logger.Fields{"func": "NewNATSBus", "brokerHost": host})
+
+	options := []nats.Option{
+		nats.UserInfo("rpi", "tastypi314"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(natsReconnectWait),
+		nats.DisconnectHandler(func(nc *nats.Conn) {
+			log.WithError(nc.LastError()).Warnln("Lost connection to message broker.")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.WithField("server", nc.ConnectedUrl()).Infoln("Reconnected to message broker, subscriptions restored.")
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			log.Infoln("Connection to message broker closed.")
+		}),
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		if timeout < nats.DefaultTimeout {
+			options = append(options, nats.Timeout(timeout))
+		}
+	}
+
+	backoff := NewBackoff()
+	for {
+		nc, err := nats.Connect("nats://"+host, options...)
+		if err != nil {
+			delay := backoff.Next()
+			if !deadline.IsZero() {
+				remaining := deadline.Sub(time.Now())
+				if remaining <= 0 {
+					log.WithError(err).Warnln("Could not connect to message broker, giving up.")
+					return nil, ErrConnectTimeout
+				}
+				if delay > remaining {
+					delay = remaining
+				}
+			}
+
+			log.WithFields(logger.Fields{
+				"error": err,
+				"retry": delay,
+			}).Warnln("Could not connect to message broker.")
+			time.Sleep(delay)
+			continue
+		}
+		log.Infoln("Connected to message broker.")
+
+		ec, err := nats.NewEncodedConn(nc, nats.GOB_ENCODER)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+
+		return &NATSBus{conn: ec}, nil
+	}
+}
+
+func (b *NATSBus) Subscribe(subject string, handler EnvelopeHandler) (BusSubscription, error) {
+	sub, err := b.conn.Subscribe(subject, func(subj, reply string, env *sModels.Envelope) {
+		handler(subj, reply, env)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (b *NATSBus) Request(subject string, env, response *sModels.Envelope, timeout time.Duration) error {
+	err := b.conn.Request(subject, env, response, timeout)
+	if err == nats.ErrTimeout {
+		return ErrRequestTimeout
+	}
+	return err
+}
+
+func (b *NATSBus) Publish(subject string, env *sModels.Envelope) error {
+	return b.conn.Publish(subject, env)
+}
+
+func (b *NATSBus) Connected() bool {
+	return b.conn.Conn.IsConnected()
+}
+
+func (b *NATSBus) Close() {
+	b.conn.Close()
+}
+
+// LocalBus is an in-process MessageBus for installs where the gateway and the module subscriptions
+// all live inside a single igor process and no broker is available.
+type LocalBus struct {
+	lock          sync.RWMutex
+	subscriptions map[string][]*localSubscription
+	inboxes       uint64
+	closed        bool
+}
+
+type localSubscription struct {
+	bus     *LocalBus
+	subject string
+	handler EnvelopeHandler
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{subscriptions: make(map[string][]*localSubscription)}
+}
+
+func (b *LocalBus) Subscribe(subject string, handler EnvelopeHandler) (BusSubscription, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+
+	sub := &localSubscription{bus: b, subject: subject, handler: handler}
+	b.subscriptions[subject] = append(b.subscriptions[subject], sub)
+	return sub, nil
+}
+
+func (b *LocalBus) Request(subject string, env, response *sModels.Envelope, timeout time.Duration) error {
+	b.lock.Lock()
+	b.inboxes++
+	inbox := localInboxPrefix + strconv.FormatUint(b.inboxes, 10)
+	b.lock.Unlock()
+
+	replies := make(chan *sModels.Envelope, 1)
+	sub, err := b.Subscribe(inbox, func(subj, reply string, env *sModels.Envelope) {
+		select {
+		case replies <- env:
+		default:
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	if err := b.publish(subject, inbox, env); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-replies:
+		*response = *reply
+		return nil
+	case <-timer.C:
+		return ErrRequestTimeout
+	}
+}
+
+func (b *LocalBus) Publish(subject string, env *sModels.Envelope) error {
+	return b.publish(subject, "", env)
+}
+
+func (b *LocalBus) publish(subject, reply string, env *sModels.Envelope) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	for _, sub := range b.subscriptions[subject] {
+		// every subscriber gets its own copy since handlers are free to modify what they receive
+		copied := *env
+		go sub.handler(subject, reply, &copied)
+	}
+	return nil
+}
+
+func (b *LocalBus) Connected() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return !b.closed
+}
+
+func (b *LocalBus) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	b.subscriptions = make(map[string][]*localSubscription)
+}
+
+func (s *localSubscription) Unsubscribe() error {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+
+	subs := s.bus.subscriptions[s.subject]
+	for i, sub := range subs {
+		if sub == s {
+			s.bus.subscriptions[s.subject] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(s.bus.subscriptions[s.subject]) == 0 {
+		delete(s.bus.subscriptions, s.subject)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	sModels "github.com/alittlebrighter/switchboard/models"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/alittlebrighter/igor/models"
+	"github.com/alittlebrighter/igor/modules"
+)
+
+const (
+	// BuiltinModule is the name requests use to reach igor itself instead of one of its modules.
+	BuiltinModule = modules.BuiltinModule
+	CatalogMethod = "catalog"
+	// AuditMethod takes an AuditQuery as its arguments.
+	AuditMethod = "audit"
+	// BansMethod lists the bans in effect, BanMethod and UnbanMethod take BanArgs.
+	BansMethod  = "bans"
+	BanMethod   = "ban"
+	UnbanMethod = "unban"
+	// CatalogKey holds the []CatalogEntry in the Data of a catalog response, AuditKey the
+	// []AuditRecord of an audit response.
+	CatalogKey = "modules"
+	AuditKey   = "records"
+	BansKey    = "bans"
+)
+
+// CatalogEntry describes one module and the methods it serves so clients can build their UIs.
+type CatalogEntry struct {
+	Name    string              `json:"name"`
+	Up      bool                `json:"up"`
+	Methods []modules.MethodDoc `json:"methods"`
+}
+
+type byName []CatalogEntry
+
+func (c byName) Len() int           { return len(c) }
+func (c byName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+
+// ServeBuiltins answers requests to BuiltinModule arriving over the message bus, e.g. from igorctl
+// running next to igor, and records them in the audit log.  Like the modules, anything on the bus is
+// trusted.
+func (g *Gateway) ServeBuiltins() (err error) {
+	g.builtins, err = g.bus.Subscribe(modules.ModulePrefix+BuiltinModule, func(subj, reply string, env *sModels.Envelope) {
+		start := time.Now()
+		req := new(models.Request)
+		header, err := OpenContents(env.Contents, req)
+
+		var resp *models.Response
+		if err != nil {
+			log.WithError(err).Errorln("Could not open the contents of the message.")
+			resp = models.NewErrorResponse(BuiltinModule, req.Method, errorCode(err, models.ErrorDecode), "Could not open the contents of the message.")
+		} else {
+			resp = g.dispatchBuiltin(env.From, req)
+		}
+		g.audit.Record(env.From, &models.Request{Module: BuiltinModule, Method: req.Method, Args: req.Args}, resp, time.Since(start))
+
+		if env.Contents, err = SealContents(header, resp); err != nil {
+			log.WithError(err).Errorln("Could not seal the contents of the response.")
+			return
+		}
+		if err := g.bus.Publish(reply, env); err != nil {
+			log.WithError(err).Errorln("Could not publish reply.")
+		}
+	})
+	return
+}
+
+// adminBuiltin reports whether module.method is one of the built-in methods that read the audit log or
+// change the bans.  Clients only reach them when an ACL grants them.
+func adminBuiltin(module, method string) bool {
+	if module != BuiltinModule {
+		return false
+	}
+	switch method {
+	case AuditMethod, BansMethod, BanMethod, UnbanMethod:
+		return true
+	}
+	return false
+}
+
+// BanArgs are the arguments of BanMethod and UnbanMethod.  Sender is a client ID or the IP address of a
+// local API client.  Duration (in milliseconds) defaults to the configured BanDuration.
+type BanArgs struct {
+	Sender   string
+	Duration time.Duration
+}
+
+// dispatchBuiltin answers requests made to BuiltinModule.
+func (g *Gateway) dispatchBuiltin(sender *uuid.UUID, req *models.Request) *models.Response {
+	switch req.Method {
+	case CatalogMethod:
+		resp := models.NewResponse(BuiltinModule)
+		resp.Success = true
+		resp.Data[CatalogKey] = g.modules.Catalog()
+		return resp
+	case AuditMethod:
+		if g.audit == nil {
+			return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnavailable, "The audit log is not enabled.")
+		}
+
+		query := AuditQuery{}
+		if len(req.Args) > 0 && string(req.Args) != "null" {
+			if err := json.Unmarshal(req.Args, &query); err != nil {
+				return models.NewErrorResponse(req.Module, req.Method, models.ErrorInvalidArgs, err.Error())
+			}
+		}
+
+		records, err := g.audit.Query(query)
+		if err != nil {
+			log.WithError(err).Errorln("Could not query the audit log.")
+			return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnavailable, "Could not query the audit log.")
+		}
+
+		resp := models.NewResponse(BuiltinModule)
+		resp.Success = true
+		resp.Data[AuditKey] = records
+		return resp
+	case BansMethod, BanMethod, UnbanMethod:
+		return g.manageBans(req)
+	default:
+		log.WithFields(log.Fields{
+			"sender": sender,
+			"method": req.Method,
+		}).Warningln("Request for unknown built-in method.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnknownMethod, "Unknown method: "+req.Module+"."+req.Method)
+	}
+}
+
+func (g *Gateway) manageBans(req *models.Request) *models.Response {
+	if g.bans == nil {
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnavailable, "Bans are not enabled.")
+	}
+
+	args := BanArgs{}
+	if req.Method != BansMethod {
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			return models.NewErrorResponse(req.Module, req.Method, models.ErrorInvalidArgs, err.Error())
+		} else if _, err := uuid.FromString(args.Sender); err != nil && net.ParseIP(args.Sender) == nil {
+			return models.NewErrorResponse(req.Module, req.Method, models.ErrorInvalidArgs, "Sender must be a client ID or an IP address.")
+		}
+	}
+
+	switch req.Method {
+	case BanMethod:
+		ban := g.bans.Ban(args.Sender, args.Duration*durationUnit)
+		log.WithFields(log.Fields{
+			"sender": ban.Sender,
+			"until":  ban.Until,
+		}).Warningln("Banned sender on request.")
+	case UnbanMethod:
+		if g.bans.Unban(args.Sender) {
+			log.WithField("sender", args.Sender).Warningln("Lifted ban on request.")
+		}
+	}
+
+	resp := models.NewResponse(BuiltinModule)
+	resp.Success = true
+	resp.Data[BansKey] = g.bans.List()
+	return resp
+}
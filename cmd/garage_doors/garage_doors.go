@@ -18,21 +18,29 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/alittlebrighter/igor/models"
+	"github.com/alittlebrighter/igor/modules"
 	"github.com/alittlebrighter/igor/modules/garage_doors"
 )
 
 func main() {
 	configFileName := flag.String("config", "/etc/igor/modules/garage_doors.conf", "The JSON formatted file the specifies the configuration Igor should use.")
 	debugMode := flag.Bool("debug", false, "Sets the logging level to DEBUG.")
+	checkConfig := flag.Bool("check-config", false, "Checks the configuration file, reports every problem found and exits.")
 	flag.Parse()
 
+	if *checkConfig {
+		os.Exit(runCheckConfig(*configFileName))
+	}
+
 	log.SetLevel(log.WarnLevel)
 	if *debugMode {
 		log.SetLevel(log.DebugLevel)
@@ -49,10 +57,40 @@ func main() {
 	}
 
 	module := new(garageDoors.GarageDoors)
-	module.Configure(models.Request{Args: configFile}, nil)
+	if err := module.Configure(models.Request{Args: configFile}, nil); err != nil {
+		log.WithFields(log.Fields{
+			"fileName": *configFileName,
+			"error":    err,
+		}).Fatalln("Module could not be configured.")
+	}
 	log.Debugln("Module configured.")
 
 	if err := garageDoors.ServeRPC(module); err != nil {
 		log.WithError(err).Fatalln("Module RPC server could not be started.")
 	}
 }
+
+// runCheckConfig validates the configuration in filename, printing every problem found, and returns
+// the exit code.
+func runCheckConfig(filename string) int {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		config := new(garageDoors.Config)
+		if err = json.Unmarshal(data, config); err == nil {
+			err = config.Validate()
+		}
+	}
+
+	if errs, ok := err.(modules.ConfigErrors); ok {
+		for _, fieldErr := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, fieldErr)
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", filename)
+	return 0
+}
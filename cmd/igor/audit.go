@@ -0,0 +1,67 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alittlebrighter/igor"
+)
+
+const (
+	auditCommand = "audit"
+
+	auditUsage = `Usage: igor [flags] audit verify [file...]
+
+  verify          check that the audit log was not tampered with, the configured audit log and its
+                  rotated files are checked unless files are given oldest first, either way they have
+                  to end in the configured head signed by the device key`
+)
+
+var errAuditUsage = errors.New(auditUsage)
+
+func runAudit(config *igor.Config, args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return errAuditUsage
+	}
+
+	files := args[1:]
+	if len(files) == 0 {
+		if config.AuditLog == "" {
+			return errors.New("No audit log is configured.")
+		}
+		files = igor.AuditFiles(config.AuditLog, config.AuditMaxFiles)
+	}
+
+	key, err := igor.LoadDevicePublicKey(config.DeviceKeyfile)
+	if err != nil {
+		return err
+	}
+	head, err := igor.ReadAuditHead(config.AuditHead())
+	if err != nil {
+		return err
+	}
+
+	count, err := igor.VerifyAudit(files, head, key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Audit log intact: %d records in %d files.\n", count, len(files))
+	return nil
+}
@@ -20,91 +20,191 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/alittlebrighter/switchboard-client/security"
-	"github.com/nats-io/nats"
 	"github.com/radovskyb/watcher"
 
 	"github.com/alittlebrighter/igor"
+	"github.com/alittlebrighter/igor/modules"
 )
 
 func main() {
 	configFileName := flag.String("config", "/etc/igor/igor.conf", "The JSON formatted file the specifies the configuration Igor should use.")
 	debugMode := flag.Bool("debug", false, "Sets the logging level to DEBUG.")
+	printKey := flag.Bool("print-key", false, "Prints the device public key for pairing clients and exits.")
+	printID := flag.Bool("print-id", false, "Prints the ID Igor uses on the relay server for pairing clients and exits.")
+	checkConfig := flag.Bool("check-config", false, "Checks the configuration file, reports every problem found and exits.")
 	flag.Parse()
 
+	if *checkConfig {
+		os.Exit(runCheckConfig(*configFileName))
+	}
+
 	log.SetLevel(log.WarnLevel)
 	if *debugMode {
 		log.SetLevel(log.DebugLevel)
 		log.Debug("Set logging level to DebugLevel.")
 	}
 
-	configFile, err := ioutil.ReadFile(*configFileName)
+	config, err := loadConfig(*configFileName, *debugMode)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"fileName": *configFileName,
 			"error":    err,
-		}).Fatalln("Configuration file could not be read.")
+		}).Fatalln("Configuration could not be loaded.")
 	}
 
-	config := new(igor.Config)
-	if err := json.Unmarshal(configFile, config); err != nil {
+	level, err := config.Level()
+	if err != nil {
+		log.WithError(err).Fatalln("Unknown log level.")
+	}
+	log.SetLevel(level)
+
+	if *printID {
+		fmt.Println(config.ID.String())
+		return
+	}
+
+	if flag.Arg(0) == auditCommand {
+		if err := runAudit(config, flag.Args()[1:]); err == errAuditUsage {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		} else if err != nil {
+			log.WithError(err).Fatalln("Audit command failed.")
+		}
+		return
+	}
+
+	keyring, err := igor.LoadKeyring(config.Keyring, config.Keyfile)
+	if err != nil && (err != igor.ErrNoKeys || flag.Arg(0) != keysCommand) {
 		log.WithFields(log.Fields{
-			"fileName": *configFileName,
-			"error":    err,
-		}).Fatalln("Configuration file could not be parsed.")
+			"keyring": config.Keyring,
+			"keyfile": config.Keyfile,
+			"error":   err,
+		}).Fatalln("Shared keys could not be loaded.")
+	}
+	igor.SetKeyring(keyring)
+
+	if flag.Arg(0) == keysCommand {
+		if err := runKeys(keyring, flag.Args()[1:]); err == errKeysUsage {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		} else if err != nil {
+			log.WithError(err).Fatalln("Keys command failed.")
+		}
+		return
 	}
 
-	if _, err := os.Stat(config.Keyfile); os.IsNotExist(err) {
+	device, err := igor.LoadOrGenerateDeviceKey(config.DeviceKeyfile)
+	if err != nil {
 		log.WithFields(log.Fields{
-			"fileName": config.Keyfile,
+			"fileName": config.DeviceKeyfile,
 			"error":    err,
-		}).Fatalln("Key file not found.")
+		}).Fatalln("Device key could not be loaded.")
 	}
-	security.SetSharedKeyFile(config.Keyfile)
 
-	// setup connection to local gnatsd server
-	// TODO: run through interface so we aren't specifically dependent on nats
-	nc, err := nats.Connect("nats://"+config.PrivateRelay, nats.UserInfo("rpi", "tastypi314"))
+	if *printKey {
+		encoded, err := device.EncodedPublicKey()
+		if err != nil {
+			log.WithError(err).Fatalln("Device public key could not be encoded.")
+		}
+		fmt.Println(encoded)
+		return
+	}
+
+	// setup connection to the message broker carrying requests to the modules
+	bus, err := igor.NewMessageBus(config, 0)
 	if err != nil {
 		log.WithFields(log.Fields{
+			"broker":     config.Broker,
 			"brokerHost": config.PrivateRelay,
 			"error":      err,
 		}).Fatalln("Could not connect to message broker.")
 	}
 
-	ec, err := nats.NewEncodedConn(nc, nats.GOB_ENCODER)
+	senders, err := igor.LoadSenderRegistry(config.ApprovedSenders)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"brokerHost": config.PrivateRelay,
-			"error":      err,
-		}).Fatalln("Could not initiate encoded connection.")
+			"fileName": config.ApprovedSenders,
+			"error":    err,
+		}).Fatalln("Approved senders could not be loaded.")
+	} else if senders.Len() == 0 {
+		log.Warnln("No approved senders configured, all incoming requests will be rejected.")
 	}
 
-	igor.ConnectToWWW(config, ec)
-
-	subscriptions := map[string]*igor.SubscriptionClient{}
-	defer func() {
-		for key, sub := range subscriptions {
-			sub.Client.Close()
-			sub.Subscription.Unsubscribe()
-			delete(subscriptions, key)
+	var audit *igor.AuditLog
+	if config.AuditLog != "" {
+		if audit, err = igor.OpenAuditLog(config.AuditLog, config.AuditHead(), device, config.AuditMaxSize, config.AuditMaxFiles); err != nil {
+			log.WithFields(log.Fields{
+				"fileName": config.AuditLog,
+				"error":    err,
+			}).Fatalln("Audit log could not be opened.")
 		}
-	}()
+	} else {
+		log.Warnln("No audit log configured, requests will not be recorded.")
+	}
 
-	wg := new(sync.WaitGroup)
+	registry := igor.NewModuleRegistry(bus, config.ModuleSocketDir, audit)
+	go registry.Monitor(config.HealthCheckInterval * time.Millisecond)
 
-	w := watcher.New()
+	events, err := igor.ServeEvents(bus, registry)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"directory": config.ModuleSocketDir,
+			"error":     err,
+		}).Fatalln("Could not serve module events.")
+	}
 
-	go func() {
-		defer wg.Done()
-		igor.ProcessFileEvents(w, config.ModuleSocketDir, subscriptions, ec)
-	}()
+	acl, err := igor.NewACL(config.ACL)
+	if err != nil {
+		log.WithError(err).Fatalln("ACL could not be parsed.")
+	} else if acl == nil {
+		log.Warnln("No ACL configured, approved senders may call any module method.")
+	}
+
+	bans, err := igor.LoadBanList(config.BanFile, config.BanThreshold, config.BanWindow*time.Millisecond, config.BanDuration*time.Millisecond)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"fileName": config.BanFile,
+			"error":    err,
+		}).Fatalln("Ban list could not be loaded.")
+	}
+
+	gateway := igor.NewGateway(config, bus, registry, senders, device, acl, audit, bans)
+	gateway.ConnectToWWW()
+	if err := gateway.BroadcastEvents(); err != nil {
+		log.WithError(err).Fatalln("Could not subscribe to module events.")
+	}
+	if err := gateway.ServeBuiltins(); err != nil {
+		log.WithError(err).Fatalln("Could not serve built-in requests on the message broker.")
+	}
+
+	if config.APIAddress != "" {
+		if err := gateway.ServeAPI(); err != nil {
+			log.WithFields(log.Fields{
+				"address": config.APIAddress,
+				"error":   err,
+			}).Fatalln("Could not serve local API.")
+		}
+	}
+	if config.MetricsAddress != "" {
+		if err := gateway.ServeMetrics(); err != nil {
+			log.WithFields(log.Fields{
+				"address": config.MetricsAddress,
+				"error":   err,
+			}).Fatalln("Could not serve metrics.")
+		}
+	}
+
+	w := watcher.New()
+	stopWatching := make(chan struct{})
+	go igor.ProcessFileEvents(w, registry, stopWatching)
 
 	if err := w.Add(config.ModuleSocketDir); err != nil {
 		log.WithFields(log.Fields{
@@ -114,11 +214,127 @@ func main() {
 	}
 
 	log.WithField("directory", config.ModuleSocketDir).Debugln("Starting file watcher.")
-	if err := w.Start(time.Duration(5) * time.Second); err != nil {
-		log.WithError(err).Fatalln("Could not start watching module socket directory.")
+	go func() {
+		if err := w.Start(time.Duration(5) * time.Second); err != nil {
+			log.WithError(err).Fatalln("Could not start watching module socket directory.")
+		}
+	}()
+
+	configWatcher := watcher.New()
+	if err := configWatcher.Add(*configFileName); err != nil {
+		log.WithFields(log.Fields{
+			"fileName": *configFileName,
+			"error":    err,
+		}).Fatalln("Could not add configuration file to watch list.")
+	}
+	go func() {
+		if err := configWatcher.Start(time.Duration(5) * time.Second); err != nil {
+			log.WithError(err).Fatalln("Could not start watching configuration file.")
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for running := true; running; {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadConfig(gateway, *configFileName, *debugMode)
+				continue
+			}
+			log.WithField("signal", sig).Infoln("Shutting down.")
+			running = false
+		case event := <-configWatcher.Event:
+			// the file disappears for a moment when an editor replaces it
+			if event.EventType != watcher.EventFileDeleted {
+				reloadConfig(gateway, *configFileName, *debugMode)
+			}
+		case err := <-configWatcher.Error:
+			log.WithFields(log.Fields{
+				"fileName": *configFileName,
+				"error":    err,
+			}).Warnln("Could not check configuration file for changes.")
+		}
 	}
 
-	wg.Add(1)
+	close(stopWatching)
+	events.Close()
+	if err := gateway.Shutdown(config.ShutdownTimeout * time.Millisecond); err != nil {
+		log.WithError(err).Warnln("Some requests were not answered before shutting down.")
+	}
+	registry.Close()
+	bus.Close()
+	audit.Close()
+}
+
+// readConfig reads the configuration in filename and validates it.
+func readConfig(filename string) (*igor.Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
 
-	wg.Wait()
+	config := new(igor.Config)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, config.Validate()
+}
+
+// runCheckConfig validates the configuration in filename, printing every problem found, and returns
+// the exit code.
+func runCheckConfig(filename string) int {
+	_, err := readConfig(filename)
+	if errs, ok := err.(modules.ConfigErrors); ok {
+		for _, fieldErr := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, fieldErr)
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", filename)
+	return 0
+}
+
+// loadConfig reads and validates the configuration in filename and makes sure it has an ID.  The
+// -debug flag wins over the log level in the file.
+func loadConfig(filename string, debug bool) (*igor.Config, error) {
+	config, err := readConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := igor.LoadOrCreateID(config, igor.IDFile(filename)); err != nil {
+		return nil, err
+	}
+
+	if debug {
+		config.LogLevel = log.DebugLevel.String()
+	}
+	return config, nil
+}
+
+// reloadConfig applies the configuration in filename to gateway, keeping the running configuration if
+// it cannot be loaded.
+func reloadConfig(gateway *igor.Gateway, filename string, debug bool) {
+	config, err := loadConfig(filename, debug)
+	var restart []string
+	if err == nil {
+		restart, err = gateway.Reload(config)
+	}
+
+	switch {
+	case err != nil:
+		log.WithFields(log.Fields{
+			"fileName": filename,
+			"error":    err,
+		}).Errorln("Configuration could not be reloaded, keeping the current one.")
+	case len(restart) > 0:
+		log.WithField("fields", restart).Warnln("Reloaded configuration, restart igor to apply the remaining changes.")
+	default:
+		log.Infoln("Reloaded configuration.")
+	}
 }
@@ -0,0 +1,89 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alittlebrighter/igor"
+)
+
+const (
+	keysCommand = "keys"
+
+	keysUsage = `Usage: igor [flags] keys <command>
+
+  generate        add a new shared key, clients need it before it is made primary
+  list            list the active shared keys
+  rotate <id>     make a generated key primary once every client has it
+  retire <id>     remove a key, envelopes encrypted with it are rejected from then on`
+)
+
+var errKeysUsage = errors.New(keysUsage)
+
+// runKeys manages the shared keys in keyring.  A running igor picks up the changes on its own.
+func runKeys(keyring *igor.Keyring, args []string) error {
+	if len(args) == 0 {
+		return errKeysUsage
+	}
+
+	switch {
+	case args[0] == "generate" && len(args) == 1:
+		info, err := keyring.Generate()
+		if err != nil {
+			return err
+		}
+		printKey(info)
+		return nil
+	case args[0] == "list" && len(args) == 1:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED\tPRIMARY")
+		for _, key := range keyring.List() {
+			created := "-"
+			if !key.Created.IsZero() {
+				created = key.Created.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\n", key.ID, created, key.Primary)
+		}
+		return w.Flush()
+	case args[0] == "rotate" && len(args) == 2:
+		if err := keyring.Rotate(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Key %s is now primary, retire the previous key once nothing uses it.\n", args[1])
+		return nil
+	case args[0] == "retire" && len(args) == 2:
+		if err := keyring.Retire(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Key %s retired.\n", args[1])
+		return nil
+	default:
+		return errKeysUsage
+	}
+}
+
+// printKey shows a new key so it can be handed to the clients.
+func printKey(info igor.KeyInfo) {
+	fmt.Printf("Generated key %s: %s\n", info.ID, base64.StdEncoding.EncodeToString(info.Key))
+}
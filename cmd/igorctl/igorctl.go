@@ -0,0 +1,232 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/alittlebrighter/igor"
+	"github.com/alittlebrighter/igor/models"
+)
+
+const usage = `Usage: igorctl [flags] <command>
+
+Commands:
+  list                                 list every module igor knows and its methods
+  docs <module>                        show the methods of a module and their arguments
+  invoke <module> <method> [args...]   call a method, args are name=value pairs or a single JSON object
+
+Flags:
+`
+
+const (
+	ViaBroker = "broker"
+	ViaRelay  = "relay"
+
+	FormatJSON  = "json"
+	FormatTable = "table"
+)
+
+func main() {
+	configFileName := flag.String("config", "/etc/igor/igor.conf", "The JSON formatted configuration of the igor to talk to.")
+	keyfile := flag.String("key", "igorctl.key", "The private key igorctl signs requests with, it is generated if it does not exist.  Its ID is kept next to it.")
+	via := flag.String("via", ViaBroker, "How to reach igor, \""+ViaBroker+"\" to use its message broker directly or \""+ViaRelay+"\" to go through the switchboard relay.")
+	format := flag.String("format", FormatTable, "How to print responses, \""+FormatTable+"\" or \""+FormatJSON+"\".")
+	timeout := flag.Int("timeout", 5000, "How long (in milliseconds) to wait to connect and for each response.")
+	debugMode := flag.Bool("debug", false, "Sets the logging level to DEBUG.")
+	printKey := flag.Bool("print-key", false, "Prints the ID and public key to add to igor's approved senders and exits.")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	log.SetLevel(log.WarnLevel)
+	if *debugMode {
+		log.SetLevel(log.DebugLevel)
+		log.Debug("Set logging level to DebugLevel.")
+	}
+
+	key, err := igor.LoadOrGenerateDeviceKey(*keyfile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"fileName": *keyfile,
+			"error":    err,
+		}).Fatalln("Key could not be loaded or generated.")
+	}
+
+	// the client ID is kept the same way igor keeps its own
+	client := new(igor.Config)
+	idFile := filepath.Join(filepath.Dir(*keyfile), "igorctl.id")
+	if err := igor.LoadOrCreateID(client, idFile); err != nil {
+		log.WithFields(log.Fields{
+			"fileName": idFile,
+			"error":    err,
+		}).Fatalln("ID could not be loaded or saved.")
+	}
+
+	if *printKey {
+		encoded, err := key.EncodedPublicKey()
+		if err != nil {
+			log.WithError(err).Fatalln("Could not encode public key.")
+		}
+		fmt.Printf("%q: %q\n", client.ID.String(), encoded)
+		return
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := loadConfig(*configFileName)
+	keyring, err := igor.LoadKeyring(config.Keyring, config.Keyfile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"keyring": config.Keyring,
+			"keyfile": config.Keyfile,
+			"error":   err,
+		}).Fatalln("Shared keys could not be loaded.")
+	}
+	igor.SetKeyring(keyring)
+
+	wait := time.Duration(*timeout) * time.Millisecond
+
+	var conn Conn
+	switch *via {
+	case ViaBroker:
+		conn, err = DialBroker(config, client.ID, wait)
+	case ViaRelay:
+		conn, err = DialRelay(config, igor.IDFile(*configFileName), client.ID, key)
+	default:
+		err = fmt.Errorf("Unknown way to reach igor: %s.", *via)
+	}
+	if err != nil {
+		log.WithError(err).Fatalln("Could not reach igor.")
+	}
+	defer conn.Close()
+
+	printer, err := NewPrinter(*format, os.Stdout)
+	if err != nil {
+		log.WithError(err).Fatalln("Could not print responses.")
+	}
+
+	args := flag.Args()
+
+	var resp *models.Response
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		resp = request(conn, igor.BuiltinModule, igor.CatalogMethod, nil, wait)
+		err = printer.Catalog(resp, "")
+	case args[0] == "docs" && len(args) == 2:
+		resp = request(conn, igor.BuiltinModule, igor.CatalogMethod, nil, wait)
+		err = printer.Catalog(resp, args[1])
+	case args[0] == "invoke" && len(args) >= 3:
+		methodArgs, parseErr := parseArgs(args[3:])
+		if parseErr != nil {
+			log.WithError(parseErr).Fatalln("Could not parse the arguments.")
+		}
+		resp = request(conn, args[1], args[2], methodArgs, wait)
+		err = printer.Response(resp)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.WithError(err).Fatalln("Could not print the response.")
+	} else if !resp.Success {
+		os.Exit(1)
+	}
+}
+
+func loadConfig(filename string) *igor.Config {
+	configFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"fileName": filename,
+			"error":    err,
+		}).Fatalln("Configuration file could not be read.")
+	}
+
+	config := new(igor.Config)
+	if err := json.Unmarshal(configFile, config); err != nil {
+		log.WithFields(log.Fields{
+			"fileName": filename,
+			"error":    err,
+		}).Fatalln("Configuration file could not be parsed.")
+	}
+	return config
+}
+
+// request sends a single request and exits if igor could not be reached.
+func request(conn Conn, module, method string, args json.RawMessage, timeout time.Duration) *models.Response {
+	req, err := models.NewRequest(module, method, args)
+	if err != nil {
+		log.WithError(err).Fatalln("Could not create the request.")
+	}
+
+	resp, err := conn.Request(req, timeout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"module": module,
+			"method": method,
+			"error":  err,
+		}).Fatalln("Request failed.")
+	}
+	return resp
+}
+
+// parseArgs turns the method arguments given on the command line into a JSON object.  A single
+// argument starting with "{" is taken as is, anything else is a list of name=value pairs where values
+// that are not valid JSON are taken as strings.
+func parseArgs(args []string) (json.RawMessage, error) {
+	if len(args) == 0 {
+		return nil, nil
+	} else if len(args) == 1 && strings.HasPrefix(args[0], "{") {
+		if err := json.Unmarshal([]byte(args[0]), new(map[string]interface{})); err != nil {
+			return nil, errors.New("Arguments are not a valid JSON object.")
+		}
+		return json.RawMessage(args[0]), nil
+	}
+
+	values := make(map[string]interface{}, len(args))
+	for _, arg := range args {
+		pair := strings.SplitN(arg, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("Argument %q is not a name=value pair.", arg)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(pair[1]), &value); err != nil {
+			value = pair[1]
+		}
+		values[pair[0]] = value
+	}
+	return json.Marshal(values)
+}
@@ -0,0 +1,179 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alittlebrighter/igor"
+	"github.com/alittlebrighter/igor/models"
+	"github.com/alittlebrighter/igor/modules"
+)
+
+// Printer writes responses from igor either as indented JSON or as tables meant for people.
+type Printer struct {
+	out   io.Writer
+	table bool
+}
+
+func NewPrinter(format string, out io.Writer) (*Printer, error) {
+	switch format {
+	case FormatJSON:
+		return &Printer{out: out}, nil
+	case FormatTable:
+		return &Printer{out: out, table: true}, nil
+	default:
+		return nil, fmt.Errorf("Unknown output format: %s.", format)
+	}
+}
+
+// Response prints any response.
+func (p *Printer) Response(resp *models.Response) error {
+	if !p.table {
+		return p.json(resp)
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "MODULE\t%s\n", resp.Module)
+	fmt.Fprintf(w, "SUCCESS\t%t\n", resp.Success)
+
+	keys := make([]string, 0, len(resp.Data))
+	for key := range resp.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, ok := resp.Data[key].(string)
+		if !ok {
+			data, err := json.Marshal(resp.Data[key])
+			if err != nil {
+				return err
+			}
+			value = string(data)
+		}
+		fmt.Fprintf(w, "%s\t%s\n", strings.ToUpper(key), value)
+	}
+	return w.Flush()
+}
+
+// Catalog prints the modules in a catalog response, or the methods of module if it is not empty.
+func (p *Printer) Catalog(resp *models.Response, module string) error {
+	if !resp.Success {
+		return p.Response(resp)
+	}
+
+	// the catalog went through JSON so it has to go back through it to get its type back
+	data, err := json.Marshal(resp.Data[igor.CatalogKey])
+	if err != nil {
+		return err
+	}
+	var catalog []igor.CatalogEntry
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return err
+	}
+
+	if module == "" {
+		if !p.table {
+			return p.json(catalog)
+		}
+		return p.modules(catalog)
+	}
+
+	for _, entry := range catalog {
+		if entry.Name != module {
+			continue
+		}
+
+		if !p.table {
+			return p.json(entry)
+		}
+		return p.methods(entry.Methods)
+	}
+	return fmt.Errorf("Unknown module: %s.", module)
+}
+
+func (p *Printer) modules(catalog []igor.CatalogEntry) error {
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tSTATUS\tMETHODS")
+	for _, entry := range catalog {
+		status := "up"
+		if !entry.Up {
+			status = "down"
+		}
+
+		names := make([]string, len(entry.Methods))
+		for i, method := range entry.Methods {
+			names[i] = method.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Name, status, strings.Join(names, ", "))
+	}
+	return w.Flush()
+}
+
+func (p *Printer) methods(methods []modules.MethodDoc) error {
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tARGUMENT\tTYPE\tREQUIRED\tALLOWED")
+	for _, method := range methods {
+		if len(method.Args) == 0 {
+			fmt.Fprintf(w, "%s\t-\t\t\t\n", method.Name)
+		}
+		for _, arg := range method.Args {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", method.Name, arg.Name, arg.Type, arg.Required, allowed(arg))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, method := range methods {
+		if method.Human != "" {
+			fmt.Fprintf(p.out, "\n%s: %s\n", method.Name, method.Human)
+		}
+	}
+	return nil
+}
+
+// allowed describes the values arg accepts beyond its type.
+func allowed(arg modules.ArgDoc) string {
+	switch {
+	case len(arg.Options) > 0:
+		return strings.Join(arg.Options, ", ")
+	case arg.Min != nil && arg.Max != nil:
+		return fmt.Sprintf("%v to %v", *arg.Min, *arg.Max)
+	case arg.Min != nil:
+		return fmt.Sprintf(">= %v", *arg.Min)
+	case arg.Max != nil:
+		return fmt.Sprintf("<= %v", *arg.Max)
+	}
+	return ""
+}
+
+func (p *Printer) json(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(p.out, string(data))
+	return err
+}
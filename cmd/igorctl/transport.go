@@ -0,0 +1,201 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	sModels "github.com/alittlebrighter/switchboard/models"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/alittlebrighter/igor"
+	"github.com/alittlebrighter/igor/models"
+	"github.com/alittlebrighter/igor/modules"
+)
+
+const relayConnectTimeout = 10 * time.Second
+
+var (
+	ErrLocalBroker = errors.New("The local broker only exists inside the igor process, use the relay instead.")
+	ErrUnknownIgor = errors.New("igor's ID is unknown, set it in the configuration or run igorctl next to igor.id.")
+)
+
+// Conn sends a request to igor and waits for the response.
+type Conn interface {
+	Request(req *models.Request, timeout time.Duration) (*models.Response, error)
+	Close() error
+}
+
+// brokerConn talks to the modules over igor's message broker, the same way igor itself does.  Nothing
+// on the broker is checked against the approved senders so neither is igorctl.
+type brokerConn struct {
+	bus  igor.MessageBus
+	from *uuid.UUID
+}
+
+// DialBroker connects to the broker in config, giving up after timeout.
+func DialBroker(config *igor.Config, from *uuid.UUID, timeout time.Duration) (Conn, error) {
+	if config.Broker == igor.BrokerLocal {
+		return nil, ErrLocalBroker
+	}
+
+	bus, err := igor.NewMessageBus(config, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &brokerConn{bus: bus, from: from}, nil
+}
+
+func (c *brokerConn) Request(req *models.Request, timeout time.Duration) (*models.Response, error) {
+	contents, err := igor.SealContents(models.ContentsHeader{}, req)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(sModels.Envelope)
+	if err := c.bus.Request(modules.ModulePrefix+req.Module, &sModels.Envelope{From: c.from, Contents: contents}, response, timeout); err != nil {
+		return nil, err
+	}
+
+	resp := new(models.Response)
+	if _, err := igor.OpenContents(response.Contents, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *brokerConn) Close() error {
+	c.bus.Close()
+	return nil
+}
+
+// relayConn reaches igor through the public switchboard server like any other paired client.
+type relayConn struct {
+	relay  *igor.RelayConn
+	igorID *uuid.UUID
+	from   *uuid.UUID
+	key    *igor.DeviceKey
+	// igor holds igor's public key when it is known so its responses can be verified.
+	igor *igor.SenderRegistry
+}
+
+// DialRelay connects to the relay configured in config.  igor's ID is taken from config or else from
+// idFile, its public key from next to config.DeviceKeyfile.
+func DialRelay(config *igor.Config, idFile string, from *uuid.UUID, key *igor.DeviceKey) (Conn, error) {
+	igorID := config.ID
+	if igorID == nil {
+		var err error
+		if igorID, err = igor.LoadID(idFile); err != nil {
+			log.WithError(err).Debugln("Could not load igor's ID.")
+			return nil, ErrUnknownIgor
+		}
+	}
+
+	conn := &relayConn{igorID: igorID, from: from, key: key}
+
+	igorKey, err := igor.LoadDevicePublicKey(config.DeviceKeyfile)
+	if _, unreadable := err.(*os.PathError); unreadable {
+		log.WithError(err).Warnln("igor's public key could not be read, its responses will not be verified.")
+	} else if err != nil {
+		return nil, err
+	} else {
+		conn.igor = igor.NewSenderRegistry()
+		conn.igor.Approve(*igorID, igorKey)
+	}
+
+	conn.relay = igor.NewRelayConn(from, config.PublicRelay)
+	go conn.relay.Run()
+
+	deadline := time.Now().Add(relayConnectTimeout)
+	for !conn.relay.Connected() {
+		if time.Now().After(deadline) {
+			conn.relay.Close()
+			return nil, igor.ErrNotConnected
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return conn, nil
+}
+
+func (c *relayConn) Request(req *models.Request, timeout time.Duration) (*models.Response, error) {
+	contents, err := igor.SealContents(models.ContentsHeader{}, req)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := c.key.Sign(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(timeout)
+	env := &sModels.Envelope{To: c.igorID, From: c.from, Contents: contents, Signature: signature, Expires: &expires}
+	if err := c.relay.SendMessage(env); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case env, ok := <-c.relay.Incoming():
+			if !ok {
+				return nil, igor.ErrRelayClosed
+			}
+			if resp := c.open(env); resp != nil {
+				return resp, nil
+			}
+		case <-timer.C:
+			return nil, igor.ErrRequestTimeout
+		}
+	}
+}
+
+// open returns the response in env or nil if env is not a response from igor.
+func (c *relayConn) open(env *sModels.Envelope) *models.Response {
+	if env.From == nil || !uuid.Equal(*env.From, *c.igorID) {
+		return nil
+	}
+
+	if c.igor != nil {
+		if err := c.igor.Verify(env); err != nil {
+			log.WithError(err).Warnln("Ignoring envelope that claims to be from igor.")
+			return nil
+		}
+	}
+
+	resp := new(models.Response)
+	if _, err := igor.OpenContents(env.Contents, resp); err != nil {
+		log.WithError(err).Warnln("Could not open the contents of the envelope.")
+		return nil
+	}
+
+	// events are broadcast to every client, they do not answer anything
+	if resp.Broadcast {
+		return nil
+	}
+	return resp
+}
+
+func (c *relayConn) Close() error {
+	return c.relay.Close()
+}
@@ -0,0 +1,193 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alittlebrighter/igor/modules"
+)
+
+// Validate normalizes the paths in c and checks every field, so a mistake is reported when igor starts
+// instead of when the field is first used.  Problems are returned as modules.ConfigErrors with the
+// fields named the way they are written in igor.conf.
+func (c *Config) Validate() error {
+	errs := modules.ConfigErrors{}
+
+	if _, err := c.Level(); err != nil {
+		errs.Add("logLevel", "Must be one of debug, info, warning or error.")
+	}
+
+	checkAddress(&errs, "publicRelay", c.PublicRelay, true)
+	switch c.Broker {
+	case BrokerNATS, "":
+		checkAddress(&errs, "privateRelay", c.PrivateRelay, true)
+	case BrokerLocal:
+	default:
+		errs.Add("broker", "Must be "+BrokerNATS+" or "+BrokerLocal+".")
+	}
+
+	switch {
+	case c.Keyring == "" && c.Keyfile == "":
+		errs.Add("keyring", "Either keyring or keyfile must be set.")
+	case c.Keyring == "":
+		// without a keyring the legacy key is the only key
+		errs.CheckFile("keyfile", c.Keyfile)
+	default:
+		// "igor keys generate" creates the keyring
+		errs.CheckParent("keyring", c.Keyring)
+	}
+
+	if c.ApprovedSenders != "" {
+		errs.CheckFile("approvedSenders", c.ApprovedSenders)
+	}
+	if c.DeviceKeyfile != "" {
+		errs.CheckParent("deviceKeyfile", c.DeviceKeyfile)
+	}
+
+	c.ModuleSocketDir = modules.NormalizeDir(c.ModuleSocketDir)
+	errs.CheckDir("moduleSocketDir", c.ModuleSocketDir)
+
+	if c.APIAddress != "" {
+		checkAddress(&errs, "apiAddress", c.APIAddress, false)
+		errs.CheckFile("apiCertfile", c.APICertfile)
+		errs.CheckFile("apiKeyfile", c.APIKeyfile)
+	}
+	if c.MetricsAddress != "" {
+		checkAddress(&errs, "metricsAddress", c.MetricsAddress, false)
+	}
+
+	if _, err := NewACL(c.ACL); err != nil {
+		errs.Add("acl", err.Error())
+	}
+
+	if c.AuditLog != "" {
+		errs.CheckParent("auditLog", c.AuditLog)
+		if c.AuditHeadfile != "" {
+			errs.CheckParent("auditHeadfile", c.AuditHeadfile)
+		}
+	}
+	if c.BanFile != "" {
+		errs.CheckParent("banFile", c.BanFile)
+	}
+
+	// the registry dials every file that shows up in moduleSocketDir as a module socket
+	auditHead := ""
+	if c.AuditLog != "" {
+		auditHead = c.AuditHead()
+	}
+	for _, file := range []struct{ field, filename string }{
+		{"keyfile", c.Keyfile},
+		{"keyring", c.Keyring},
+		{"approvedSenders", c.ApprovedSenders},
+		{"deviceKeyfile", c.DeviceKeyfile},
+		{"apiCertfile", c.APICertfile},
+		{"apiKeyfile", c.APIKeyfile},
+		{"auditLog", c.AuditLog},
+		{"auditHeadfile", auditHead},
+		{"banFile", c.BanFile},
+	} {
+		if file.filename != "" && inDir(c.ModuleSocketDir, file.filename) {
+			errs.Add(file.field, "Must not be in moduleSocketDir, igor takes every file there for a module socket.")
+		}
+	}
+
+	for _, number := range []struct {
+		field string
+		value float64
+	}{
+		{"clockSkew", float64(c.ClockSkew)},
+		{"nonceCacheSize", float64(c.NonceCacheSize)},
+		{"responseTTL", float64(c.ResponseTTL)},
+		{"healthCheckInterval", float64(c.HealthCheckInterval)},
+		{"shutdownTimeout", float64(c.ShutdownTimeout)},
+		{"defaultTimeout", float64(c.DefaultTimeout)},
+		{"auditMaxSize", float64(c.AuditMaxSize)},
+		{"auditMaxFiles", float64(c.AuditMaxFiles)},
+		{"senderRate", c.SenderRate},
+		{"senderBurst", float64(c.SenderBurst)},
+		{"moduleRate", c.ModuleRate},
+		{"moduleBurst", float64(c.ModuleBurst)},
+		{"banThreshold", float64(c.BanThreshold)},
+		{"banWindow", float64(c.BanWindow)},
+		{"banDuration", float64(c.BanDuration)},
+	} {
+		if number.value < 0 {
+			errs.Add(number.field, "Must not be negative.")
+		}
+	}
+
+	keys := make([]string, 0, len(c.Timeouts))
+	for key := range c.Timeouts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" {
+			errs.Add("timeouts", "Keys must name a module or module.method.")
+		} else if c.Timeouts[key] <= 0 {
+			errs.Add("timeouts."+key, "Must be positive.")
+		}
+	}
+
+	return errs.Err()
+}
+
+// inDir reports whether filename is in dir or any directory below it.
+func inDir(dir, filename string) bool {
+	if dir == "" {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absFile, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(absDir, absFile)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkAddress records a problem unless address is host:port.  Addresses igor listens on may leave
+// out the host.
+func checkAddress(errs *modules.ConfigErrors, field, address string, needHost bool) {
+	if address == "" {
+		errs.Add(field, "Required.")
+		return
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		errs.Add(field, "Must be host:port.")
+		return
+	}
+
+	if needHost && host == "" {
+		errs.Add(field, "Host is missing.")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		errs.Add(field, "Port must be a number from 1 to 65535.")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	DefaultDeviceKeyfile = "device.key"
+	publicKeySuffix      = ".pub"
+	signatureIntLen      = 32
+)
+
+// DeviceKey is igor's own key pair.  Every envelope igor sends is signed with it so clients that
+// pinned the public key at pairing time can tell a genuine reply from a forged one.
+type DeviceKey struct {
+	private *ecdsa.PrivateKey
+}
+
+// LoadOrGenerateDeviceKey reads the private key stored in filename, generating and saving a new one
+// if the file does not exist yet.  The public key is (re)written next to it with a .pub suffix.
+func LoadOrGenerateDeviceKey(filename string) (*DeviceKey, error) {
+	if filename == "" {
+		filename = DefaultDeviceKeyfile
+	}
+
+	key := new(DeviceKey)
+	data, err := ioutil.ReadFile(filename)
+	switch {
+	case os.IsNotExist(err):
+		if key.private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+
+		if data, err = x509.MarshalECPrivateKey(key.private); err != nil {
+			return nil, err
+		}
+
+		if err = ioutil.WriteFile(filename, data, 0400); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if key.private, err = x509.ParseECPrivateKey(data); err != nil {
+			return nil, err
+		}
+	}
+
+	encoded, err := key.EncodedPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	os.Remove(filename + publicKeySuffix)
+	if err := ioutil.WriteFile(filename+publicKeySuffix, []byte(encoded+"\n"), 0444); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// LoadDevicePublicKey reads the public key LoadOrGenerateDeviceKey wrote next to filename.
+func LoadDevicePublicKey(filename string) (*ecdsa.PublicKey, error) {
+	if filename == "" {
+		filename = DefaultDeviceKeyfile
+	}
+
+	data, err := ioutil.ReadFile(filename + publicKeySuffix)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(strings.TrimSpace(string(data)))
+}
+
+func (k *DeviceKey) PublicKey() *ecdsa.PublicKey {
+	return &k.private.PublicKey
+}
+
+// EncodedPublicKey returns the public key in the form clients pin and LoadSenderRegistry reads.
+func (k *DeviceKey) EncodedPublicKey() (string, error) {
+	return EncodePublicKey(k.PublicKey())
+}
+
+// Sign produces a signature of msg that switchboard-client/security.VerifyFromString accepts.  The
+// security package only signs with a key in the working directory so the scheme is reproduced here.
+func (k *DeviceKey) Sign(msg string) (string, error) {
+	hash := md5.Sum([]byte(msg))
+
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	// r and s are left padded so the verifier can always split the signature in half
+	sig := make([]byte, 2*signatureIntLen)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(sig[signatureIntLen-len(rBytes):signatureIntLen], rBytes)
+	copy(sig[2*signatureIntLen-len(sBytes):], sBytes)
+
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,89 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"github.com/alittlebrighter/igor/models"
+)
+
+// contentsError records which step of opening or sealing contents failed as a models error code.
+type contentsError struct {
+	code string
+	err  error
+}
+
+func (e *contentsError) Error() string {
+	return e.err.Error()
+}
+
+// errorCode returns the models error code recorded in err, or fallback if there is none.
+func errorCode(err error, fallback string) string {
+	if cErr, ok := err.(*contentsError); ok {
+		return cErr.code
+	}
+	return fallback
+}
+
+// OpenContents decrypts the contents of an envelope with the key named in the contents header and
+// decodes them into v using the format named there.  The header returned names the key actually used
+// so a reply sealed with it can be read by the sender.
+func OpenContents(contents string, v interface{}) (models.ContentsHeader, error) {
+	header, encrypted := models.ParseContents(contents)
+
+	codec, err := models.GetCodec(header.Format)
+	if err != nil {
+		// answer in a format the sender is guaranteed to understand at least the header of
+		return models.ContentsHeader{}, &contentsError{code: models.ErrorDecode, err: err}
+	}
+
+	var data []byte
+	header.KeyID, data, err = keyring.Decrypt(header.KeyID, encrypted)
+	if err == ErrUnknownKey {
+		// the sender may still have the primary key
+		return models.ContentsHeader{Format: header.Format}, &contentsError{code: models.ErrorUnknownKey, err: err}
+	} else if err != nil {
+		return header, &contentsError{code: models.ErrorDecrypt, err: err}
+	}
+
+	if err := codec.Unmarshal(data, v); err != nil {
+		return header, &contentsError{code: models.ErrorDecode, err: err}
+	}
+	return header, nil
+}
+
+// SealContents is the inverse of OpenContents.  Contents are sealed with the primary key unless the
+// header names another one.
+func SealContents(header models.ContentsHeader, v interface{}) (string, error) {
+	codec, err := models.GetCodec(header.Format)
+	if err != nil {
+		return "", &contentsError{code: models.ErrorMarshal, err: err}
+	}
+
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return "", &contentsError{code: models.ErrorMarshal, err: err}
+	}
+
+	var encrypted string
+	header.KeyID, encrypted, err = keyring.Encrypt(header.KeyID, data)
+	if err != nil {
+		return "", &contentsError{code: models.ErrorMarshal, err: err}
+	}
+
+	return models.FormatContents(header, encrypted), nil
+}
@@ -0,0 +1,139 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	sModels "github.com/alittlebrighter/switchboard/models"
+
+	"github.com/alittlebrighter/igor/models"
+	"github.com/alittlebrighter/igor/modules"
+)
+
+var ErrUnknownEventToken = errors.New("Unknown event token, only modules subscribed by igor can publish events.")
+
+// EventPublisher is served over RPC on the event socket so modules, which only talk to igor over
+// their own sockets, can put events on the message bus.
+type EventPublisher struct {
+	bus     MessageBus
+	modules *ModuleRegistry
+}
+
+// Publish seals the event in args and publishes it on modules.EventSubject as coming from the module
+// args.Token was handed to.
+func (p *EventPublisher) Publish(args modules.PublishArgs, published *bool) error {
+	module, ok := p.modules.EventSender(args.Token)
+	if !ok {
+		log.Warningln("Rejected event with an unknown token.")
+		return ErrUnknownEventToken
+	}
+
+	event := args.Event
+	event.Module = module
+	event.Broadcast = true
+
+	contents, err := SealContents(models.ContentsHeader{}, &event)
+	if err != nil {
+		return err
+	}
+
+	if err := p.bus.Publish(modules.EventSubject, &sModels.Envelope{Contents: contents}); err != nil {
+		return err
+	}
+
+	*published = true
+	return nil
+}
+
+// ServeEvents listens for events from the modules in registry on the event socket in its socket
+// directory.  The socket is only open to igor's group, like the module sockets.  Closing the returned
+// listener stops it.
+func ServeEvents(bus MessageBus, registry *ModuleRegistry) (io.Closer, error) {
+	socketDir := registry.SocketDir()
+
+	// remove any previous sockets
+	os.Remove(socketDir + modules.EventSocket)
+
+	listener, err := net.Listen("unix", socketDir+modules.EventSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketDir+modules.EventSocket, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName(modules.EventService, &EventPublisher{bus: bus, modules: registry}); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go server.Accept(listener)
+
+	return listener, nil
+}
+
+// BroadcastEvents subscribes the gateway to modules.EventSubject and forwards every event published
+// there to every paired client, through the relay server and to anyone listening on the local API.
+func (g *Gateway) BroadcastEvents() (err error) {
+	g.events, err = g.bus.Subscribe(modules.EventSubject, func(subj, reply string, env *sModels.Envelope) {
+		event := new(models.Response)
+		if _, err := OpenContents(env.Contents, event); err != nil {
+			log.WithError(err).Errorln("Could not open the contents of the event.")
+			return
+		}
+		event.Broadcast = true
+
+		g.metrics.Event(event)
+		g.broadcast(event)
+	})
+	return
+}
+
+func (g *Gateway) broadcast(event *models.Response) {
+	log.WithField("module", event.Module).Debugln("Broadcasting event.")
+
+	g.notifyListeners(event)
+
+	if g.relay == nil {
+		return
+	}
+
+	// clients have to be able to read events they did not ask for so they go out in the default format
+	contents, err := SealContents(models.ContentsHeader{}, event)
+	if err != nil {
+		log.WithError(err).Errorln("Could not seal the contents of the event.")
+		return
+	}
+
+	for _, id := range g.senders.List() {
+		to := id
+		if err := g.send(&sModels.Envelope{To: &to, From: g.Config().ID, Contents: contents}); err != nil {
+			log.WithFields(log.Fields{
+				"client": to,
+				"error":  err,
+			}).Errorln("Could not send event to client.")
+		}
+	}
+}
@@ -18,89 +18,435 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package igor
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/alittlebrighter/switchboard-client"
-	"github.com/alittlebrighter/switchboard-client/security"
 	sModels "github.com/alittlebrighter/switchboard/models"
-	"github.com/nats-io/nats"
 	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/websocket"
 
 	"github.com/alittlebrighter/igor/models"
 	"github.com/alittlebrighter/igor/modules"
 )
 
-func ConnectToWWW(config *Config, conn *nats.EncodedConn) error {
-	log.Debugln("Connecting to public switchboard server.")
+const (
+	DefaultResponseTTL     = 5 * time.Minute
+	DefaultShutdownTimeout = 10 * time.Second
+)
 
-	id := config.ID
-	if id == nil {
-		newID := uuid.NewV1()
-		id = &newID
-		log.WithField("ID", id.String()).Debugln("Created new ID.")
-	}
+var ErrShutdownTimeout = errors.New("Timed out waiting for requests in flight.")
+
+// Gateway relays requests arriving from the public switchboard server to the modules and sends their
+// responses back to the requestor.
+type Gateway struct {
+	bus      MessageBus
+	modules  *ModuleRegistry
+	senders  *SenderRegistry
+	device   *DeviceKey
+	replays  *ReplayGuard
+	audit    *AuditLog
+	bans     *BanList
+	metrics  *Metrics
+	relay    Relay
+	api      *http.Server
+	events   BusSubscription
+	builtins BusSubscription
+
+	metricsServer *http.Server
 
-	// setup connection to public relay server
-	client := relayClient.New(id, config.PublicRelay, config.Keyfile, json.Marshal, json.Unmarshal)
-	if err := client.OpenSocket(); err != nil {
-		return err
+	senderLimit, moduleLimit *RateLimiter
+	// unverifiedLimit throttles logging and auditing requests that fail verification
+	unverifiedLimit *RateLimiter
+
+	// config and acl are replaced by Reload
+	configLock sync.RWMutex
+	config     *Config
+	acl        *ACL
+
+	lock      sync.Mutex
+	stopping  bool
+	inFlight  sync.WaitGroup
+	listeners map[*websocket.Conn]*uuid.UUID
+}
+
+func NewGateway(config *Config, bus MessageBus, modules *ModuleRegistry, senders *SenderRegistry, device *DeviceKey, acl *ACL, audit *AuditLog, bans *BanList) *Gateway {
+	return &Gateway{
+		config:  config,
+		bus:     bus,
+		modules: modules,
+		senders: senders,
+		device:  device,
+		acl:     acl,
+		audit:   audit,
+		bans:    bans,
+		metrics: NewMetrics(),
+
+		senderLimit:     NewRateLimiter(config.SenderRate, config.SenderBurst),
+		moduleLimit:     NewRateLimiter(config.ModuleRate, config.ModuleBurst),
+		unverifiedLimit: NewRateLimiter(unverifiedRate, unverifiedBurst),
+		replays:         NewReplayGuard(config.ClockSkew*durationUnit, config.NonceCacheSize),
+
+		listeners: make(map[*websocket.Conn]*uuid.UUID),
 	}
+}
 
-	incoming, err := client.ReadMessages()
-	if err != nil {
-		return err
+// Config returns the configuration the gateway runs with.
+func (g *Gateway) Config() *Config {
+	g.configLock.RLock()
+	defer g.configLock.RUnlock()
+	return g.config
+}
+
+func (g *Gateway) allowed(sender *uuid.UUID, module, method string) bool {
+	g.configLock.RLock()
+	acl := g.acl
+	g.configLock.RUnlock()
+
+	// the bus, where igorctl asks for them, stays the way to the admin built-ins without an ACL
+	if acl == nil && adminBuiltin(module, method) {
+		return false
 	}
+	return acl.Allowed(sender, module, method)
+}
 
-	// start reading and processing incoming envelopes
-	go processEnvelopes(client, incoming, conn)
+// ConnectToWWW starts a supervised connection to the public switchboard server and processes the
+// envelopes it relays.  The gateway's config must have an ID, see LoadOrCreateID.
+func (g *Gateway) ConnectToWWW() {
+	config := g.Config()
+	log.WithField("ID", config.ID.String()).Debugln("Connecting to public switchboard server.")
 
-	return nil
+	relay := NewRelayConn(config.ID, config.PublicRelay)
+	go relay.Run()
+	g.ServeRelay(relay)
 }
 
-func processEnvelopes(client *relayClient.RelayClient, incoming chan *sModels.Envelope, out *nats.EncodedConn) {
+// ServeRelay processes the envelopes relay delivers and sends the replies back over it.
+func (g *Gateway) ServeRelay(relay Relay) {
+	g.relay = relay
+
+	// start reading and processing incoming envelopes
+	go g.processEnvelopes(relay.Incoming())
+}
+
+func (g *Gateway) processEnvelopes(incoming <-chan *sModels.Envelope) {
 	for envelope := range incoming {
-		// TODO: verify the message is from an approved sender by reading the signature
-		data, err := security.DecryptFromString(envelope.Contents)
-		if err != nil {
-			log.WithError(err).Errorln("Could not decrypt the contents of the message.")
-			continue
+		g.processEnvelope(envelope)
+	}
+
+	log.Warningln("Channel closed.  All incoming messages have been processed.")
+}
+
+// processEnvelope forwards the request in envelope to its module and sends the module's response back
+// to the requestor.  Once the sender is verified every failure is answered with an error response and
+// the ones that take the sender's key count towards banning it.
+func (g *Gateway) processEnvelope(envelope *sModels.Envelope) {
+	g.metrics.Envelope()
+
+	sender := senderKey(envelope.From)
+	if g.bans.Banned(sender) {
+		log.WithField("sender", sender).Debugln("Dropped envelope from banned sender.")
+		g.metrics.Rejected("banned")
+		return
+	}
+
+	// anyone can claim to be sender so failing verification only throttles, it never bans sender
+	if err := g.senders.Verify(envelope); err != nil {
+		g.metrics.Rejected(OutcomeUnverified)
+		if !g.unverifiedLimit.Allow(unverifiedKey) {
+			return
 		}
 
-		contents := new(models.Request)
-		// TODO: unmarshal from any serialization format
-		if json.Unmarshal(data, contents); err != nil {
-			log.WithError(err).Errorln("Could not unmarshal the contents of the message.")
-			continue
+		log.WithFields(log.Fields{
+			"sender": envelope.From,
+			"error":  err,
+		}).Warningln("Rejected envelope from unverified sender.")
+		g.audit.Rejected(sender)
+		return
+	}
+
+	// checked before decrypting so a flood of envelopes costs as little as possible
+	if !g.senderLimit.Allow(sender) {
+		log.WithField("sender", sender).Warningln("Dropped envelope from sender over its rate limit.")
+		g.metrics.Rejected(models.ErrorRateLimited)
+		return
+	}
+
+	contents := new(models.Request)
+	header, err := OpenContents(envelope.Contents, contents)
+	if err != nil {
+		log.WithError(err).Errorln("Could not open the contents of the message.")
+		code := errorCode(err, models.ErrorDecode)
+		if code == models.ErrorDecrypt || code == models.ErrorUnknownKey {
+			g.bans.Failure(sender)
+		}
+		g.metrics.Rejected(code)
+		g.replyError(envelope, header, contents, code, "Could not open the contents of the message.")
+		return
+	}
+
+	if !g.begin() {
+		resp := models.NewErrorResponse(contents.Module, contents.Method, models.ErrorUnavailable, "Igor is shutting down.")
+		g.audit.Record(envelope.From, contents, resp, 0)
+		g.reply(envelope, header, resp)
+		return
+	}
+	defer g.inFlight.Done()
+
+	if envelope.Expires != nil && time.Now().After(*envelope.Expires) {
+		log.WithFields(log.Fields{
+			"sender":  envelope.From,
+			"module":  contents.Module,
+			"method":  contents.Method,
+			"expires": envelope.Expires,
+		}).Warningln("Dropped expired request.")
+		g.metrics.Rejected(models.ErrorExpired)
+		resp := models.NewErrorResponse(contents.Module, contents.Method, models.ErrorExpired, "Request expired.")
+		g.audit.Record(envelope.From, contents, resp, 0)
+		g.reply(envelope, header, resp)
+		return
+	}
+
+	g.reply(envelope, header, g.dispatch(envelope.From, contents))
+}
+
+// senderKey identifies sender in the rate limiter and ban list.
+func senderKey(sender *uuid.UUID) string {
+	if sender == nil {
+		return ""
+	}
+	return sender.String()
+}
+
+// dispatch hands req from sender to its module once it passes every check igor makes, no matter how
+// the request arrived, and records the outcome in the audit log and the metrics.  Failures are returned as error
+// responses so the caller can always answer.
+func (g *Gateway) dispatch(sender *uuid.UUID, req *models.Request) *models.Response {
+	start := time.Now()
+	resp := g.route(sender, req)
+	latency := time.Since(start)
+	g.audit.Record(sender, req, resp, latency)
+	g.recordRequest(req, resp, latency)
+	return resp
+}
+
+// route returns the response to req.
+func (g *Gateway) route(sender *uuid.UUID, req *models.Request) *models.Response {
+	if err := g.replays.Check(senderKey(sender), req); err != nil {
+		log.WithFields(log.Fields{
+			"sender": sender,
+			"nonce":  req.Nonce,
+			"error":  err,
+		}).Warningln("Rejected stale or replayed request.")
+
+		code := models.ErrorStale
+		if err == ErrReplayedRequest {
+			code = models.ErrorReplayed
+		} else if err == ErrNonceCacheFull {
+			code = models.ErrorUnavailable
 		}
+		return models.NewErrorResponse(req.Module, req.Method, code, err.Error())
+	}
+
+	if !g.allowed(sender, req.Module, req.Method) {
+		log.WithFields(log.Fields{
+			"sender": sender,
+			"module": req.Module,
+			"method": req.Method,
+		}).Warningln("Denied request not allowed by the ACL.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorForbidden, "Not allowed to call "+req.Module+"."+req.Method+".")
+	}
 
+	if !g.moduleLimit.Allow(req.Module) {
 		log.WithFields(log.Fields{
-			"topic": modules.ModulePrefix + contents.Module,
-		}).Debugln("Sending request.")
+			"sender": sender,
+			"module": req.Module,
+		}).Warningln("Rejected request for module over its rate limit.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorRateLimited, "Module is over its rate limit: "+req.Module)
+	}
+
+	if req.Module == BuiltinModule {
+		return g.dispatchBuiltin(sender, req)
+	}
 
-		response := new(sModels.Envelope)
-		if err = out.Request(modules.ModulePrefix+contents.Module, envelope, response, 2*time.Second); err != nil {
+	if _, ok := g.modules.Get(req.Module); !ok && g.modules.IsDown(req.Module) {
+		log.WithField("module", req.Module).Warningln("Request for module that is down.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnavailable, "Module is down: "+req.Module)
+	} else if !ok {
+		log.WithField("module", req.Module).Warningln("Request for unknown module.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnknownModule, "Unknown module: "+req.Module)
+	}
+
+	// a module that declared its methods only serves those, older modules are left to check for themselves
+	doc, documented := g.modules.Method(req.Module, req.Method)
+	if modules.Internal(req.Method) || (!documented && g.modules.Documented(req.Module)) {
+		log.WithFields(log.Fields{
+			"sender": sender,
+			"module": req.Module,
+			"method": req.Method,
+		}).Warningln("Request for unknown method.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnknownMethod, "Unknown method: "+req.Module+"."+req.Method)
+	} else if documented {
+		if err := doc.Validate(req.Args); err != nil {
 			log.WithFields(log.Fields{
-				"module": contents.Module,
+				"module": req.Module,
+				"method": req.Method,
 				"error":  err,
-			}).Errorln("Could not solicit response from module.")
-			continue
+			}).Warningln("Rejected request with invalid arguments.")
+			return models.NewErrorResponse(req.Module, req.Method, models.ErrorInvalidArgs, err.Error())
 		}
+	}
+
+	// requests travel to the module subscriptions sealed in the default format
+	contents, err := SealContents(models.ContentsHeader{}, req)
+	if err != nil {
+		log.WithError(err).Errorln("Could not seal the request for the module.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorMarshal, "Could not seal the request for the module.")
+	}
+
+	log.WithFields(log.Fields{
+		"topic": modules.ModulePrefix + req.Module,
+	}).Debugln("Sending request.")
 
+	config := g.Config()
+	timeout := config.RequestTimeout(req.Module, req.Method)
+	response := new(sModels.Envelope)
+	if err := g.bus.Request(modules.ModulePrefix+req.Module, &sModels.Envelope{To: config.ID, From: sender, Contents: contents, Signature: g.modules.RelayToken()}, response, timeout); err == ErrRequestTimeout {
 		log.WithFields(log.Fields{
-			"topic": modules.ModulePrefix + contents.Module,
-		}).Debugln("Received response.")
+			"module":  req.Module,
+			"method":  req.Method,
+			"timeout": timeout,
+		}).Errorln("Module did not respond in time.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorTimeout, "Module did not respond in time.")
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"module": req.Module,
+			"error":  err,
+		}).Errorln("Could not solicit response from module.")
+		return models.NewErrorResponse(req.Module, req.Method, models.ErrorUnavailable, "Could not reach module.")
+	}
 
-		response.To = envelope.From
-		response.From = envelope.To
+	log.WithFields(log.Fields{
+		"topic": modules.ModulePrefix + req.Module,
+	}).Debugln("Received response.")
+
+	resp := new(models.Response)
+	if _, err := OpenContents(response.Contents, resp); err != nil {
+		log.WithError(err).Errorln("Could not open the response from the module.")
+		return models.NewErrorResponse(req.Module, req.Method, errorCode(err, models.ErrorDecode), "Could not open the response from the module.")
+	}
+	return resp
+}
 
-		// TODO: generate signature
-		response.Signature = ""
+// begin registers a request as in flight unless the gateway is shutting down.
+func (g *Gateway) begin() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 
-		client.SendMessage(response)
-		log.WithField("requestor", response.To).Debugln("Response sent back to requestor.")
+	if g.stopping {
+		return false
 	}
+	g.inFlight.Add(1)
+	return true
+}
 
-	log.Warningln("Channel closed.  All incoming messages have been processed.")
+// Shutdown stops accepting requests, waits up to timeout for the ones in flight to be answered and
+// then closes the connection to the relay server.  The local API stops listening right away.
+func (g *Gateway) Shutdown(timeout time.Duration) error {
+	g.lock.Lock()
+	g.stopping = true
+	g.lock.Unlock()
+
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if g.api != nil {
+		// stops listening right away and waits for the handlers answering requests in flight
+		g.api.Shutdown(ctx)
+	}
+	if g.metricsServer != nil {
+		g.metricsServer.Close()
+	}
+	// the event listeners' websockets were hijacked from the API server so it does not close them
+	g.lock.Lock()
+	for ws := range g.listeners {
+		ws.Close()
+	}
+	g.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		g.inFlight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		log.Debugln("All requests in flight have been answered.")
+	case <-ctx.Done():
+		err = ErrShutdownTimeout
+	}
+
+	if g.events != nil {
+		g.events.Unsubscribe()
+	}
+	if g.builtins != nil {
+		g.builtins.Unsubscribe()
+	}
+	if g.relay != nil {
+		g.relay.Close()
+	}
+	return err
+}
+
+// reply seals resp in the format described by header and sends it back to the sender of env.
+func (g *Gateway) reply(env *sModels.Envelope, header models.ContentsHeader, resp *models.Response) {
+	contents, err := SealContents(header, resp)
+	if err != nil {
+		log.WithError(err).Errorln("Could not seal the contents of the response.")
+		if contents, err = SealContents(header, models.NewErrorResponse(resp.Module, "", models.ErrorMarshal, "Could not seal the contents of the response.")); err != nil {
+			return
+		}
+	}
+
+	response := &sModels.Envelope{To: env.From, From: env.To, Contents: contents}
+	if err := g.send(response); err != nil {
+		log.WithFields(log.Fields{
+			"requestor": response.To,
+			"error":     err,
+		}).Errorln("Could not send response back to requestor.")
+		return
+	}
+	log.WithField("requestor", response.To).Debugln("Response sent back to requestor.")
+}
+
+// replyError sends an error response to req back to the sender of env.
+func (g *Gateway) replyError(env *sModels.Envelope, header models.ContentsHeader, req *models.Request, code, message string) {
+	g.reply(env, header, models.NewErrorResponse(req.Module, req.Method, code, message))
+}
+
+// send stamps env with an expiration if it does not have one yet, signs it with the device key and
+// hands it to the public relay.
+func (g *Gateway) send(env *sModels.Envelope) (err error) {
+	if env.Expires == nil {
+		ttl := g.Config().ResponseTTL * durationUnit
+		if ttl <= 0 {
+			ttl = DefaultResponseTTL
+		}
+		expires := time.Now().Add(ttl)
+		env.Expires = &expires
+	}
+
+	if env.Signature, err = g.device.Sign(env.Contents); err != nil {
+		return
+	}
+
+	return g.relay.SendMessage(env)
 }
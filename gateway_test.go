@@ -0,0 +1,373 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	sModels "github.com/alittlebrighter/switchboard/models"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/alittlebrighter/igor/models"
+	"github.com/alittlebrighter/igor/modules"
+)
+
+// echoModule answers Say with the arguments it was called with, and Stall the same way but only
+// after the gateway gave up on it.
+type echoModule struct {
+	modules.BaseModule
+}
+
+func (m *echoModule) Say(req models.Request, resp *models.Response) error {
+	*resp = *models.NewResponse(m.Name)
+	resp.Success = true
+	resp.Data["args"] = string(req.Args)
+	return nil
+}
+
+func (m *echoModule) Stall(req models.Request, resp *models.Response) error {
+	time.Sleep(10 * stallTimeout * durationUnit)
+	return m.Say(req, resp)
+}
+
+// stallTimeout (in milliseconds) is how long the gateway waits for Stall.
+const stallTimeout = 10
+
+// testGateway is a gateway wired to an echo module over a LocalBus, with one approved client.
+type testGateway struct {
+	*Gateway
+	dir      string
+	keyring  *Keyring
+	device   *DeviceKey
+	audit    *AuditLog
+	client   *DeviceKey
+	clientID uuid.UUID
+}
+
+func newTestGateway(t *testing.T, bans *BanList) *testGateway {
+	dir := t.TempDir() + string(os.PathSeparator)
+	keyring := testKeyring(t, dir)
+
+	echo := &echoModule{modules.BaseModule{Name: "echo", SocketDir: dir, Methods: []modules.MethodDoc{
+		{Name: "Say", Args: []modules.ArgDoc{{Name: "text", Type: modules.TypeString, Required: true}}},
+		{Name: "Stall"},
+	}}}
+	go modules.Serve(echo, dir, echo.Name)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(dir + echo.Name); err == nil {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("Module did not start serving: %v", err)
+		}
+	}
+
+	device, err := LoadOrGenerateDeviceKey(dir + "device.key")
+	if err != nil {
+		t.Fatalf("LoadOrGenerateDeviceKey: %v", err)
+	}
+	audit, err := OpenAuditLog(dir+"audit.log", dir+"audit.head", device, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenAuditLog: %v", err)
+	}
+	t.Cleanup(func() { audit.Close() })
+
+	bus := NewLocalBus()
+	t.Cleanup(func() { bus.Close() })
+	registry := NewModuleRegistry(bus, dir, audit)
+	t.Cleanup(func() { registry.Close() })
+	if err := registry.Add(echo.Name); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	client, err := LoadOrGenerateDeviceKey(dir + "client.key")
+	if err != nil {
+		t.Fatalf("LoadOrGenerateDeviceKey: %v", err)
+	}
+	clientID := uuid.NewV4()
+	senders := NewSenderRegistry()
+	senders.Approve(clientID, client.PublicKey())
+
+	id := uuid.NewV4()
+	return &testGateway{
+		Gateway:  NewGateway(&Config{ID: &id, ModuleSocketDir: dir, Timeouts: map[string]time.Duration{"echo.Stall": stallTimeout}}, bus, registry, senders, device, nil, audit, bans),
+		dir:      dir,
+		keyring:  keyring,
+		device:   device,
+		audit:    audit,
+		client:   client,
+		clientID: clientID,
+	}
+}
+
+// records returns everything in the gateway's audit log after checking that the log verifies.
+func (g *testGateway) records(t *testing.T) []AuditRecord {
+	head, err := ReadAuditHead(g.dir + "audit.head")
+	if err != nil {
+		t.Fatalf("ReadAuditHead: %v", err)
+	}
+	if _, err := VerifyAudit(AuditFiles(g.dir+"audit.log", 0), head, g.device.PublicKey()); err != nil {
+		t.Errorf("VerifyAudit: %v", err)
+	}
+
+	records, err := g.audit.Query(AuditQuery{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	return records
+}
+
+// TestRequestPath sends requests to the local API the way a client does and checks that they travel
+// the whole way to a module's RPC server over a LocalBus and back.
+func TestRequestPath(t *testing.T) {
+	g := newTestGateway(t, nil)
+	client, device := g.client, g.device
+
+	post := func(body []byte, signature string) (int, *models.Response) {
+		r := httptest.NewRequest(http.MethodPost, RequestsPath, bytes.NewReader(body))
+		r.Header.Set(SenderHeader, g.clientID.String())
+		r.Header.Set(SignatureHeader, signature)
+		w := httptest.NewRecorder()
+		g.handleRequest(w, r)
+
+		resp := new(models.Response)
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+				t.Fatalf("Response could not be parsed: %v", err)
+			}
+		}
+		return w.Code, resp
+	}
+	request := func(module, method string, args interface{}) []byte {
+		req, err := models.NewRequest(module, method, args)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		body, _ := json.Marshal(req)
+		return body
+	}
+
+	replayed := request("echo", "Say", map[string]string{"text": "again"})
+	for _, test := range []struct {
+		name    string
+		body    []byte
+		badSig  bool
+		status  int
+		success bool
+		code    string
+	}{
+		{name: "documented method", body: request("echo", "Say", map[string]string{"text": "hi"}), status: http.StatusOK, success: true},
+		{name: "invalid arguments", body: request("echo", "Say", map[string]int{"text": 1}), status: http.StatusOK, code: models.ErrorInvalidArgs},
+		{name: "undocumented method", body: request("echo", "Shout", nil), status: http.StatusOK, code: models.ErrorUnknownMethod},
+		{name: "internal method", body: request("echo", modules.EventTokenMethod, "token"), status: http.StatusOK, code: models.ErrorUnknownMethod},
+		{name: "unknown module", body: request("lights", "On", nil), status: http.StatusOK, code: models.ErrorUnknownModule},
+		{name: "built-in method", body: request(BuiltinModule, CatalogMethod, nil), status: http.StatusOK, success: true},
+		{name: "admin built-in without an ACL", body: request(BuiltinModule, BansMethod, nil), status: http.StatusOK, code: models.ErrorForbidden},
+		{name: "first of a replay", body: replayed, status: http.StatusOK, success: true},
+		{name: "replay", body: replayed, status: http.StatusOK, code: models.ErrorReplayed},
+		{name: "bad signature", body: request("echo", "Say", map[string]string{"text": "hi"}), badSig: true, status: http.StatusUnauthorized},
+	} {
+		signature, err := client.Sign(string(test.body))
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		if test.badSig {
+			signature, _ = device.Sign(string(test.body))
+		}
+
+		status, resp := post(test.body, signature)
+		if status != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, status, test.status)
+			continue
+		} else if status != http.StatusOK {
+			continue
+		}
+
+		code, _ := resp.Data["code"].(string)
+		if resp.Success != test.success || code != test.code {
+			t.Errorf("%s: got success %t and code %q, want %t and %q", test.name, resp.Success, code, test.success, test.code)
+		}
+	}
+
+	records := g.records(t)
+	// every request is recorded once, wherever it stopped
+	if len(records) != 10 {
+		t.Errorf("Got %d audit records, want 10", len(records))
+	} else if records[0].Module != "echo" || records[0].Method != "Say" || records[0].Outcome != OutcomeSuccess {
+		t.Errorf("First audit record is %+v", records[0])
+	} else if records[9].Outcome != OutcomeUnverified {
+		t.Errorf("Last audit record is %+v", records[9])
+	}
+}
+
+// testRelay stands in for the public relay server, sent collects every envelope the gateway sends.
+type testRelay struct {
+	incoming chan *sModels.Envelope
+	sent     chan *sModels.Envelope
+}
+
+func (r *testRelay) Incoming() <-chan *sModels.Envelope      { return r.incoming }
+func (r *testRelay) SendMessage(env *sModels.Envelope) error { r.sent <- env; return nil }
+func (r *testRelay) SetHost(host string)                     {}
+func (r *testRelay) Connected() bool                         { return true }
+func (r *testRelay) Close() error                            { return nil }
+
+// TestRelayPath sends envelopes over the relay the way a client does and checks the replies igor
+// sends back, or that it sends none.
+func TestRelayPath(t *testing.T) {
+	bans, err := LoadBanList(t.TempDir()+"/bans.json", 2, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadBanList: %v", err)
+	}
+	g := newTestGateway(t, bans)
+	relay := &testRelay{incoming: make(chan *sModels.Envelope), sent: make(chan *sModels.Envelope, 1)}
+	g.ServeRelay(relay)
+	defer close(relay.incoming)
+
+	// clients verify replies against the device key
+	igorID := g.Config().ID
+	igor := NewSenderRegistry()
+	igor.Approve(*igorID, g.device.PublicKey())
+
+	seal := func(module, method string, args interface{}) string {
+		req, err := models.NewRequest(module, method, args)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		contents, err := SealContents(models.ContentsHeader{}, req)
+		if err != nil {
+			t.Fatalf("SealContents: %v", err)
+		}
+		return contents
+	}
+
+	garbage := models.FormatContents(models.ContentsHeader{KeyID: primaryKey(g.keyring)}, "Z2FyYmFnZQ==")
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Minute)
+	for _, test := range []struct {
+		name     string
+		contents string
+		badSig   bool
+		expires  *time.Time
+		reply    bool
+		success  bool
+		code     string
+		banned   bool
+	}{
+		{name: "request", contents: seal("echo", "Say", map[string]string{"text": "hi"}), expires: &future, reply: true, success: true},
+		{name: "without expiration", contents: seal("echo", "Say", map[string]string{"text": "hi"}), reply: true, success: true},
+		{name: "undocumented method", contents: seal("echo", "Shout", nil), reply: true, code: models.ErrorUnknownMethod},
+		{name: "module timeout", contents: seal("echo", "Stall", nil), reply: true, code: models.ErrorTimeout},
+		{name: "expired", contents: seal("echo", "Say", map[string]string{"text": "hi"}), expires: &past, reply: true, code: models.ErrorExpired},
+		{name: "bad signature", contents: seal("echo", "Say", map[string]string{"text": "hi"}), badSig: true},
+		{name: "unknown key", contents: "Z2FyYmFnZQ==", reply: true, code: models.ErrorUnknownKey},
+		{name: "undecryptable contents", contents: garbage, reply: true, code: models.ErrorDecrypt, banned: true},
+		{name: "banned", contents: seal("echo", "Say", map[string]string{"text": "hi"}), banned: true},
+	} {
+		signer := g.client
+		if test.badSig {
+			signer = g.device
+		}
+		signature, err := signer.Sign(test.contents)
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		relay.incoming <- &sModels.Envelope{To: igorID, From: &g.clientID, Contents: test.contents, Signature: signature, Expires: test.expires}
+
+		select {
+		case env := <-relay.sent:
+			if !test.reply {
+				t.Errorf("%s: got a reply, want none", test.name)
+				break
+			}
+			if env.To == nil || !uuid.Equal(*env.To, g.clientID) {
+				t.Errorf("%s: reply is addressed to %v", test.name, env.To)
+			}
+			if err := igor.Verify(env); err != nil {
+				t.Errorf("%s: reply could not be verified: %v", test.name, err)
+			}
+			if env.Expires == nil || !env.Expires.After(time.Now()) {
+				t.Errorf("%s: reply expires at %v", test.name, env.Expires)
+			}
+
+			resp := new(models.Response)
+			if _, err := OpenContents(env.Contents, resp); err != nil {
+				t.Errorf("%s: reply could not be opened: %v", test.name, err)
+				break
+			}
+			code, _ := resp.Data["code"].(string)
+			if resp.Success != test.success || code != test.code {
+				t.Errorf("%s: got success %t and code %q, want %t and %q", test.name, resp.Success, code, test.success, test.code)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if test.reply {
+				t.Errorf("%s: got no reply", test.name)
+			}
+		}
+
+		if banned := bans.Banned(g.clientID.String()); banned != test.banned {
+			t.Errorf("%s: got banned %t, want %t", test.name, banned, test.banned)
+		}
+	}
+	// wait for the module to answer the request the gateway gave up on
+	time.Sleep(10 * stallTimeout * durationUnit)
+
+	// every request igor could read is recorded once, wherever it stopped
+	var outcomes []string
+	for _, record := range g.records(t) {
+		outcomes = append(outcomes, record.Outcome)
+	}
+	want := []string{OutcomeSuccess, OutcomeSuccess, models.ErrorUnknownMethod, models.ErrorTimeout, models.ErrorExpired, OutcomeUnverified}
+	if !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("Got audit outcomes %v, want %v", outcomes, want)
+	}
+}
+
+// TestBusInternalMethods checks that clients on the bus can't call the methods only igor may call,
+// e.g. to take over a module's event token.
+func TestBusInternalMethods(t *testing.T) {
+	g := newTestGateway(t, nil)
+
+	for _, method := range []string{modules.PingMethod, modules.DocsMethod, modules.EventTokenMethod} {
+		req, err := models.NewRequest("echo", method, "token")
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		contents, err := SealContents(models.ContentsHeader{}, req)
+		if err != nil {
+			t.Fatalf("SealContents: %v", err)
+		}
+
+		response := new(sModels.Envelope)
+		if err := g.bus.Request(modules.ModulePrefix+"echo", &sModels.Envelope{From: &g.clientID, Contents: contents}, response, time.Second); err != nil {
+			t.Fatalf("%s: Request: %v", method, err)
+		}
+		resp := new(models.Response)
+		if _, err := OpenContents(response.Contents, resp); err != nil {
+			t.Fatalf("%s: OpenContents: %v", method, err)
+		}
+		if code, _ := resp.Data["code"].(string); resp.Success || code != models.ErrorUnknownMethod {
+			t.Errorf("%s: got success %t and code %q, want an unknown method", method, resp.Success, code)
+		}
+	}
+}
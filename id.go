@@ -0,0 +1,78 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+)
+
+const IDFileName = "igor.id"
+
+// IDFile returns where the generated ID of the igor configured by configFile is stored.
+func IDFile(configFile string) string {
+	return filepath.Join(filepath.Dir(configFile), IDFileName)
+}
+
+// LoadOrCreateID makes sure config.ID is set.  An ID in the configuration always wins, otherwise the
+// one saved in idFile is used and if there is none yet a new ID is generated and saved there so igor
+// keeps the same identity on the relay across restarts.
+func LoadOrCreateID(config *Config, idFile string) error {
+	if config.ID != nil {
+		return nil
+	}
+
+	id, err := LoadID(idFile)
+	if err == nil {
+		config.ID = id
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	generated := uuid.NewV1()
+	if err := ioutil.WriteFile(idFile, []byte(generated.String()+"\n"), 0644); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"ID":       generated.String(),
+		"fileName": idFile,
+	}).Infoln("Created new ID.")
+
+	config.ID = &generated
+	return nil
+}
+
+// LoadID reads an ID saved by LoadOrCreateID.
+func LoadID(idFile string) (*uuid.UUID, error) {
+	data, err := ioutil.ReadFile(idFile)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.FromString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
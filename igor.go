@@ -18,15 +18,16 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package igor
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"time"
 
 	logger "github.com/Sirupsen/logrus"
-	"github.com/alittlebrighter/switchboard-client/security"
 	sModels "github.com/alittlebrighter/switchboard/models"
-	"github.com/nats-io/nats"
 	"github.com/radovskyb/watcher"
 	uuid "github.com/satori/go.uuid"
 
@@ -35,19 +36,164 @@ import (
 )
 
 type Config struct {
-	ID                                                  *uuid.UUID
-	PublicRelay, PrivateRelay, Keyfile, ModuleSocketDir string
+	ID *uuid.UUID
+	// LogLevel is one of debug, info, warning or error, warning when it is not set.
+	LogLevel                                                    string
+	PublicRelay, PrivateRelay, Broker, Keyfile, ModuleSocketDir string
+	// Keyring is a JSON file holding the shared keys added by "igor keys", Keyfile holds the legacy key
+	// used before there were key IDs.
+	Keyring string
+	// ApprovedSenders is a JSON file mapping client IDs to their public keys.
+	ApprovedSenders string
+	// DeviceKeyfile holds igor's private key, the public half is written next to it.
+	DeviceKeyfile string
+	// ClockSkew (in milliseconds) is how far a request's timestamp may be from igor's clock and
+	// NonceCacheSize is how many request nonces are remembered to detect replays.
+	ClockSkew      time.Duration
+	NonceCacheSize int
+	// ResponseTTL (in milliseconds) is how long the relay should hold on to anything igor sends.
+	ResponseTTL time.Duration
+	// APIAddress enables the local HTTPS API when set, it is served with the given certificate.
+	APIAddress, APICertfile, APIKeyfile string
+	// MetricsAddress enables the Prometheus metrics endpoint over plain HTTP when set.
+	MetricsAddress string
+	// HealthCheckInterval (in milliseconds) is how often every module is pinged.
+	HealthCheckInterval time.Duration
+	// ShutdownTimeout (in milliseconds) is how long requests in flight get to finish on shutdown.
+	ShutdownTimeout time.Duration
+	// Timeouts (in milliseconds) bound how long a module may take to answer, keyed by "module" or
+	// "module.method".  DefaultTimeout applies to everything else.
+	DefaultTimeout time.Duration
+	Timeouts       map[string]time.Duration
+	// ACL limits which module methods each client may call.  Without it everything is allowed except the
+	// built-in methods for the audit log and bans.
+	ACL *ACLConfig
+	// AuditLog enables the audit log when set.  It is rotated when it grows to AuditMaxSize bytes and
+	// AuditMaxFiles rotated files are kept.  Its signed head is kept in AuditHeadfile, next to the log
+	// unless set.
+	AuditLog      string
+	AuditHeadfile string
+	AuditMaxSize  int64
+	AuditMaxFiles int
+	// SenderRate and ModuleRate (requests per second) limit how often each sender may send and each
+	// module may be called, allowing bursts of SenderBurst and ModuleBurst.  Zero disables a limit.
+	SenderRate, ModuleRate   float64
+	SenderBurst, ModuleBurst int
+	// A sender failing BanThreshold times within BanWindow (in milliseconds), e.g. with contents that
+	// cannot be decrypted, is banned for BanDuration (in milliseconds).  Bans are saved in BanFile.
+	BanThreshold           int
+	BanWindow, BanDuration time.Duration
+	BanFile                string
 }
 
+// Level returns the logging level named by LogLevel.
+func (c *Config) Level() (logger.Level, error) {
+	if c.LogLevel == "" {
+		return logger.WarnLevel, nil
+	}
+	return logger.ParseLevel(c.LogLevel)
+}
+
+// AuditHead returns the file the head of the audit log is kept in.
+func (c *Config) AuditHead() string {
+	if c.AuditHeadfile == "" {
+		return c.AuditLog + AuditHeadSuffix
+	}
+	return c.AuditHeadfile
+}
+
+// RequestTimeout returns how long to wait on module to answer a call to method.
+func (c *Config) RequestTimeout(module, method string) time.Duration {
+	if timeout, ok := c.Timeouts[module+"."+method]; ok {
+		return timeout * durationUnit
+	} else if timeout, ok := c.Timeouts[module]; ok {
+		return timeout * durationUnit
+	} else if c.DefaultTimeout > 0 {
+		return c.DefaultTimeout * durationUnit
+	}
+	return DefaultRequestTimeout
+}
+
+const (
+	// durationUnit is the unit of every duration in Config
+	durationUnit = time.Millisecond
+
+	DefaultRequestTimeout = 2 * time.Second
+)
+
+var ErrNoDocs = errors.New("Module did not document its methods.")
+
 type SubscriptionClient struct {
-	Subscription *nats.Subscription
+	Module       string
+	Subscription BusSubscription
 	Client       *rpc.Client
 }
 
-func SubscribeModule(conn *nats.EncodedConn, socketDir, moduleName string) (*SubscriptionClient, error) {
+// Ping checks that the module still answers RPC calls within timeout.
+func (s *SubscriptionClient) Ping(timeout time.Duration) error {
+	err := s.call(modules.PingMethod, nil, new(models.Response), timeout)
+	// modules built before Ping existed answer with an error, but they did answer
+	if _, ok := err.(rpc.ServerError); ok {
+		return nil
+	}
+	return err
+}
+
+// Docs asks the module to document the methods it serves.
+func (s *SubscriptionClient) Docs(timeout time.Duration) ([]modules.MethodDoc, error) {
+	resp := new(models.Response)
+	if err := s.call(modules.DocsMethod, nil, resp, timeout); err != nil {
+		return nil, err
+	}
+
+	docs, ok := resp.Data[modules.DocsKey].([]modules.MethodDoc)
+	if !ok {
+		return nil, ErrNoDocs
+	}
+	return docs, nil
+}
+
+// SetEventToken hands the module the token it has to publish its events with.
+func (s *SubscriptionClient) SetEventToken(token string, timeout time.Duration) error {
+	args, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.call(modules.EventTokenMethod, args, new(models.Response), timeout)
+}
+
+// call makes an RPC call to one of the methods igor calls on every module itself.
+func (s *SubscriptionClient) call(method string, args json.RawMessage, resp *models.Response, timeout time.Duration) error {
+	call := s.Client.Go(s.Module+"."+method, models.Request{Module: s.Module, Method: method, Args: args}, resp, make(chan *rpc.Call, 1))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return ErrRequestTimeout
+	}
+}
+
+// Close unsubscribes from the module's topic and closes the RPC client.
+func (s *SubscriptionClient) Close() error {
+	subErr := s.Subscription.Unsubscribe()
+	if err := s.Client.Close(); err != nil {
+		return err
+	}
+	return subErr
+}
+
+// SubscribeModule relays the requests published to the module called moduleName to its RPC server in
+// socketDir and records them in audit.  Every request for the module reaches it here, whether it came
+// through the gateway or straight from the bus.  The gateway records the requests it forwards itself,
+// they carry relayToken as their signature.
+func SubscribeModule(bus MessageBus, socketDir, moduleName string, audit *AuditLog, relayToken string) (*SubscriptionClient, error) {
 	log := logger.WithField("func", "SubscribeModule")
 
-	subClient := new(SubscriptionClient)
+	subClient := &SubscriptionClient{Module: moduleName}
 	var err error
 	subClient.Client, err = rpc.Dial("unix", socketDir+moduleName)
 	if err != nil {
@@ -55,57 +201,80 @@ func SubscribeModule(conn *nats.EncodedConn, socketDir, moduleName string) (*Sub
 	}
 
 	log.WithField("topic", modules.ModulePrefix+moduleName).Debugln("Subscribing to topic.")
-	subClient.Subscription, err = conn.Subscribe(modules.ModulePrefix+moduleName, func(subj, reply string, env *sModels.Envelope) {
-		data, err := security.DecryptFromString(env.Contents)
-		if err != nil {
-			log.WithError(err).Errorln("Could not decrypt the contents of the message.")
-			return
+	subClient.Subscription, err = bus.Subscribe(modules.ModulePrefix+moduleName, func(subj, reply string, env *sModels.Envelope) {
+		start := time.Now()
+		// a nil log records nothing
+		requestAudit := audit
+		if relayToken != "" && subtle.ConstantTimeCompare([]byte(env.Signature), []byte(relayToken)) == 1 {
+			requestAudit = nil
 		}
-
+		env.Signature = ""
 		contents := new(models.Request)
-		if json.Unmarshal(data, contents); err != nil {
-			log.WithError(err).Errorln("Could not unmarshal the contents of the message.")
+		header, err := OpenContents(env.Contents, contents)
+		if err != nil {
+			log.WithError(err).Errorln("Could not open the contents of the message.")
+			resp := models.NewErrorResponse(moduleName, contents.Method, errorCode(err, models.ErrorDecode), "Could not open the contents of the message.")
+			requestAudit.Record(env.From, &models.Request{Module: moduleName, Method: contents.Method}, resp, time.Since(start))
+			env.Contents, _ = SealContents(header, resp)
+			bus.Publish(reply, env)
 			return
 		}
 
 		resp := new(models.Response)
-		log.WithField("RPCCall", moduleName+"."+contents.Method).Debugln("Making RPC call to module.")
-		if err := subClient.Client.Call(moduleName+"."+contents.Method, contents, resp); err != nil {
-			log.WithError(err).Errorln("Something went wrong on the RPC server.")
-			return
-		}
-
-		mData, err := json.Marshal(resp)
-		if err != nil {
-			log.WithError(err).Errorln("Could not marshal the contents of the response.")
-			return
+		if modules.Internal(contents.Method) {
+			// igor calls these over the module's socket, never over the bus
+			log.WithFields(logger.Fields{
+				"sender": env.From,
+				"module": moduleName,
+				"method": contents.Method,
+			}).Warningln("Request for unknown method.")
+			resp = models.NewErrorResponse(moduleName, contents.Method, models.ErrorUnknownMethod, "Unknown method: "+moduleName+"."+contents.Method)
+		} else {
+			log.WithField("RPCCall", moduleName+"."+contents.Method).Debugln("Making RPC call to module.")
+			if err := subClient.Client.Call(moduleName+"."+contents.Method, contents, resp); err != nil {
+				log.WithError(err).Errorln("Something went wrong on the RPC server.")
+				resp = models.NewErrorResponse(moduleName, contents.Method, models.ErrorRPC, err.Error())
+			}
 		}
+		requestAudit.Record(env.From, &models.Request{Module: moduleName, Method: contents.Method, Args: contents.Args}, resp, time.Since(start))
 
-		env.Contents, err = security.EncryptToString(mData)
-		if err != nil {
-			log.WithError(err).Errorln("Could not encrypt the response.")
-			return
+		// reply in the same format the request was made in
+		if env.Contents, err = SealContents(header, resp); err != nil {
+			log.WithError(err).Errorln("Could not seal the contents of the response.")
+			env.Contents, _ = SealContents(models.ContentsHeader{}, models.NewErrorResponse(moduleName, contents.Method,
+				models.ErrorMarshal, "Could not seal the contents of the response."))
 		}
 
 		log.WithField("topic", reply).Debugln("Publishing reply.")
-		conn.Publish(reply, env)
+		if err := bus.Publish(reply, env); err != nil {
+			log.WithError(err).Errorln("Could not publish reply.")
+		}
 	})
 
-	return subClient, err
+	if err != nil {
+		subClient.Client.Close()
+		return nil, err
+	}
+	return subClient, nil
 }
 
-func ProcessFileEvents(w *watcher.Watcher, watched string, subscriptions map[string]*SubscriptionClient, ec *nats.EncodedConn) {
+// ProcessFileEvents keeps registry in sync with the module sockets in its socket directory until stop
+// is closed.
+func ProcessFileEvents(w *watcher.Watcher, registry *ModuleRegistry, stop <-chan struct{}) {
 	log := logger.WithField("func", "ProcessFileEvents")
+	watched := registry.SocketDir()
 
 	addSubscription := func(socket string) {
-		subClient, err := SubscribeModule(ec, watched, socket)
-		if err != nil {
+		// igor serves the event socket itself and answers to BuiltinModule
+		if socket == modules.EventSocket || socket == BuiltinModule {
+			return
+		}
+
+		if err := registry.Add(socket); err != nil {
 			log.WithFields(logger.Fields{
 				"subscription": socket,
 				"error":        err,
 			}).Errorln("Could not subscribe.")
-		} else {
-			subscriptions[socket] = subClient
 		}
 	}
 
@@ -139,18 +308,20 @@ func ProcessFileEvents(w *watcher.Watcher, watched string, subscriptions map[str
 				addSubscription(file)
 			case watcher.EventFileDeleted:
 				log.WithField("module", file).Debugln("Module closed.")
-				err := subscriptions[file].Client.Close()
-				err = subscriptions[file].Subscription.Unsubscribe()
-				if logger.GetLevel() == logger.DebugLevel {
-					log.WithError(err).Errorln("Could not close RPC client or unsubscribe.")
+				if err := registry.Remove(file); err != nil {
+					log.WithFields(logger.Fields{
+						"module": file,
+						"error":  err,
+					}).Debugln("Could not close RPC client or unsubscribe.")
 				}
-				delete(subscriptions, file)
 			}
 		case err := <-w.Error:
 			log.WithError(err).Errorln("File event resulted in an error.")
+			log.WithField("directory", watched).Warnln("Stopped watching directory.")
+			return
+		case <-stop:
+			log.WithField("directory", watched).Debugln("Stopped watching directory.")
 			return
 		}
 	}
-
-	log.WithField("directory", watched).Warnln("Stopped watching directory.")
 }
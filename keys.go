@@ -0,0 +1,389 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+const (
+	// gcmNonceLen and sharedKeyLen match the switchboard client so contents stay readable by it.
+	gcmNonceLen  = 12
+	sharedKeyLen = 32
+	keyIDLen     = 4
+)
+
+var (
+	ErrUnknownKey      = errors.New("Unknown shared key.")
+	ErrNoKeys          = errors.New("No shared keys are configured.")
+	ErrNoKeyring       = errors.New("No keyring is configured.")
+	ErrRetirePrimary   = errors.New("The primary key cannot be retired, rotate to another key first.")
+	ErrShortCiphertext = errors.New("Ciphertext is too short.")
+)
+
+// keyring is what OpenContents and SealContents encrypt with, see SetKeyring.
+var keyring = NewKeyring()
+
+// SetKeyring makes k the keyring every envelope's contents are encrypted with.
+func SetKeyring(k *Keyring) {
+	keyring = k
+}
+
+// KeyInfo is a shared key as it is stored in the keyring file.
+type KeyInfo struct {
+	ID      string
+	Key     []byte
+	Created time.Time
+}
+
+// keyringFile is the JSON layout of the keyring file.  The legacy key lives in its own file, the one
+// the switchboard client used, and is not part of it.
+type keyringFile struct {
+	Primary       string
+	Keys          []KeyInfo
+	LegacyRetired bool
+}
+
+// Keyring holds every active shared key by ID.  New contents are sealed with the primary key while
+// contents sealed with any other active key can still be opened, so clients can move to a new key
+// over time.  Changes to the keyring file are picked up as it is used.
+type Keyring struct {
+	filename, legacyFile string
+
+	lock    sync.RWMutex
+	file    keyringFile
+	keys    map[string][]byte
+	modTime time.Time
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// LoadKeyring reads the keyring file, if any, and the legacy shared key file, if it was not retired.
+// ErrNoKeys is returned along with the keyring if neither holds a key, so keys can still be generated.
+func LoadKeyring(filename, legacyFile string) (*Keyring, error) {
+	k := NewKeyring()
+	k.filename, k.legacyFile = filename, legacyFile
+
+	if err := k.load(); err != nil {
+		return nil, err
+	} else if len(k.keys) == 0 {
+		return k, ErrNoKeys
+	}
+	return k, nil
+}
+
+func (k *Keyring) load() error {
+	file := keyringFile{}
+	var modTime time.Time
+
+	if k.filename != "" {
+		info, err := os.Stat(k.filename)
+		if err == nil {
+			modTime = info.ModTime()
+
+			data, err := ioutil.ReadFile(k.filename)
+			if err != nil {
+				return err
+			} else if err := json.Unmarshal(data, &file); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	keys := make(map[string][]byte, len(file.Keys)+1)
+	for _, key := range file.Keys {
+		keys[key.ID] = key.Key
+	}
+
+	if k.legacyFile != "" && !file.LegacyRetired {
+		legacy, err := ioutil.ReadFile(k.legacyFile)
+		if err == nil {
+			keys[models.LegacyKeyID] = legacy
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// until a key is made primary the legacy key stays primary, or else the first key generated
+	if _, ok := keys[models.LegacyKeyID]; file.Primary == "" && ok {
+		file.Primary = models.LegacyKeyID
+	} else if file.Primary == "" && len(file.Keys) > 0 {
+		file.Primary = file.Keys[0].ID
+	}
+	if _, ok := keys[file.Primary]; !ok && file.Primary != "" {
+		return errors.New("The primary key is not in the keyring: " + file.Primary)
+	}
+
+	k.lock.Lock()
+	k.file, k.keys, k.modTime = file, keys, modTime
+	k.lock.Unlock()
+	return nil
+}
+
+// refresh reloads the keyring if its file changed since it was last read.  A file that cannot be
+// loaded is logged and the keys already loaded stay in use.
+func (k *Keyring) refresh() {
+	if k.filename == "" {
+		return
+	}
+
+	info, err := os.Stat(k.filename)
+	if err != nil {
+		return
+	}
+
+	k.lock.RLock()
+	changed := !info.ModTime().Equal(k.modTime)
+	k.lock.RUnlock()
+
+	if changed {
+		if err := k.load(); err != nil {
+			log.WithFields(log.Fields{
+				"fileName": k.filename,
+				"error":    err,
+			}).Errorln("Could not reload keyring, keeping the keys already loaded.")
+			return
+		}
+		log.WithField("fileName", k.filename).Infoln("Reloaded keyring.")
+	}
+}
+
+// key returns the key called id, the primary key if id is empty.
+func (k *Keyring) key(id string) (string, []byte, error) {
+	k.refresh()
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if id == "" {
+		id = k.file.Primary
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return id, nil, ErrUnknownKey
+	}
+	return id, key, nil
+}
+
+// Encrypt encrypts data with the key called id, or the primary key if id is empty, and returns the
+// ID of the key used along with the ciphertext.  The ciphertext is the AES-GCM nonce followed by the
+// sealed data, base64 encoded, the same as the switchboard client produces.
+func (k *Keyring) Encrypt(id string, data []byte) (string, string, error) {
+	id, key, err := k.key(id)
+	if err != nil {
+		return id, "", err
+	}
+
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return id, "", err
+	}
+
+	nonce := make([]byte, gcmNonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return id, "", err
+	}
+
+	return id, base64.StdEncoding.EncodeToString(aesgcm.Seal(nonce, nonce, data, nil)), nil
+}
+
+// Decrypt is the inverse of Encrypt, except that an empty id means the legacy key because that is
+// what contents without a key ID were sealed with.
+func (k *Keyring) Decrypt(id string, encrypted string) (string, []byte, error) {
+	if id == "" {
+		id = models.LegacyKeyID
+	}
+
+	id, key, err := k.key(id)
+	if err != nil {
+		return id, nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return id, nil, err
+	} else if len(data) < gcmNonceLen {
+		return id, nil, ErrShortCiphertext
+	}
+
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return id, nil, err
+	}
+
+	data, err = aesgcm.Open(nil, data[:gcmNonceLen], data[gcmNonceLen:], nil)
+	return id, data, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyStatus describes a key in the keyring without giving it away.
+type KeyStatus struct {
+	ID      string
+	Created time.Time
+	Primary bool
+}
+
+// List describes every active key, in the order they were created with the legacy key first.
+func (k *Keyring) List() []KeyStatus {
+	k.refresh()
+
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	list := []KeyStatus{}
+	if _, ok := k.keys[models.LegacyKeyID]; ok {
+		list = append(list, KeyStatus{ID: models.LegacyKeyID, Primary: k.file.Primary == models.LegacyKeyID})
+	}
+	for _, key := range k.file.Keys {
+		list = append(list, KeyStatus{ID: key.ID, Created: key.Created, Primary: k.file.Primary == key.ID})
+	}
+	return list
+}
+
+// Generate adds a new random key to the keyring file without making it the primary key, so it can be
+// handed to every client before igor starts sealing contents with it.
+func (k *Keyring) Generate() (KeyInfo, error) {
+	if k.filename == "" {
+		return KeyInfo{}, ErrNoKeyring
+	}
+
+	key := make([]byte, sharedKeyLen)
+	id := make([]byte, keyIDLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return KeyInfo{}, err
+	} else if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return KeyInfo{}, err
+	}
+	info := KeyInfo{ID: hex.EncodeToString(id), Key: key, Created: time.Now().UTC()}
+
+	err := k.update(func(file *keyringFile) error {
+		file.Keys = append(file.Keys, info)
+		return nil
+	})
+	return info, err
+}
+
+// Rotate makes the key called id the primary key.  The previous primary key stays active until it is
+// retired.
+func (k *Keyring) Rotate(id string) error {
+	return k.update(func(file *keyringFile) error {
+		if _, ok := k.keys[id]; !ok {
+			return ErrUnknownKey
+		}
+		file.Primary = id
+		return nil
+	})
+}
+
+// Retire removes the key called id, contents sealed with it can no longer be opened.
+func (k *Keyring) Retire(id string) error {
+	return k.update(func(file *keyringFile) error {
+		if _, ok := k.keys[id]; !ok {
+			return ErrUnknownKey
+		} else if file.Primary == id {
+			return ErrRetirePrimary
+		}
+
+		if id == models.LegacyKeyID {
+			file.LegacyRetired = true
+			return nil
+		}
+		for i, key := range file.Keys {
+			if key.ID == id {
+				file.Keys = append(file.Keys[:i], file.Keys[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// update applies change to the keyring file, saves it and reloads the keyring from it.
+func (k *Keyring) update(change func(*keyringFile) error) error {
+	if k.filename == "" {
+		return ErrNoKeyring
+	}
+	k.refresh()
+
+	k.lock.RLock()
+	file := k.file
+	file.Keys = append([]KeyInfo{}, k.file.Keys...)
+	err := change(&file)
+	k.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(file, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// write the whole file at once so a running igor never reads half of it
+	if err := writeFileAtomic(k.filename, data, 0600); err != nil {
+		return err
+	}
+
+	return k.load()
+}
+
+// writeFileAtomic replaces filename with data so readers see either the old or the new contents.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Close(); err != nil {
+		return err
+	} else if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,139 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+// testKeyring makes a keyring with a single generated key the one contents are sealed with.
+func testKeyring(t *testing.T, dir string) *Keyring {
+	k, err := LoadKeyring(dir+"keyring.json", "")
+	if err != ErrNoKeys {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	if _, err := k.Generate(); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	SetKeyring(k)
+	return k
+}
+
+// primaryKey returns the ID of the primary key in k.
+func primaryKey(k *Keyring) string {
+	for _, key := range k.List() {
+		if key.Primary {
+			return key.ID
+		}
+	}
+	return ""
+}
+
+func TestKeyringRotateRetire(t *testing.T) {
+	dir := t.TempDir() + string(os.PathSeparator)
+	if err := ioutil.WriteFile(dir+"shared.key", make([]byte, sharedKeyLen), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	k, err := LoadKeyring(dir+"keyring.json", dir+"shared.key")
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+
+	first, err := k.Generate()
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	second, err := k.Generate()
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if primary := primaryKey(k); primary != models.LegacyKeyID {
+		t.Fatalf("Generated keys became primary: %s", primary)
+	}
+
+	// the cases run in order against the same keyring
+	for _, test := range []struct {
+		name    string
+		action  func(id string) error
+		id      string
+		err     error
+		primary string
+		keys    int
+	}{
+		{"rotate to an unknown key", k.Rotate, "ffffffff", ErrUnknownKey, models.LegacyKeyID, 3},
+		{"rotate", k.Rotate, first.ID, nil, first.ID, 3},
+		{"retire the primary key", k.Retire, first.ID, ErrRetirePrimary, first.ID, 3},
+		{"retire the legacy key", k.Retire, models.LegacyKeyID, nil, first.ID, 2},
+		{"retire an unknown key", k.Retire, models.LegacyKeyID, ErrUnknownKey, first.ID, 2},
+		{"rotate again", k.Rotate, second.ID, nil, second.ID, 2},
+		{"retire the previous key", k.Retire, first.ID, nil, second.ID, 1},
+	} {
+		if err := test.action(test.id); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if primary := primaryKey(k); primary != test.primary {
+			t.Errorf("%s: primary key is %s, want %s", test.name, primary, test.primary)
+		}
+		if keys := len(k.List()); keys != test.keys {
+			t.Errorf("%s: %d keys left, want %d", test.name, keys, test.keys)
+		}
+	}
+
+	reloaded, err := LoadKeyring(dir+"keyring.json", dir+"shared.key")
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	if primary, keys := primaryKey(reloaded), len(reloaded.List()); primary != second.ID || keys != 1 {
+		t.Errorf("Reloaded keyring has %d keys and primary %s, want 1 and %s", keys, primary, second.ID)
+	}
+}
+
+func TestKeyringOpensContentsSealedWithActiveKeys(t *testing.T) {
+	dir := t.TempDir() + string(os.PathSeparator)
+	k := testKeyring(t, dir)
+	defer SetKeyring(NewKeyring())
+
+	old := primaryKey(k)
+	sealed, err := SealContents(models.ContentsHeader{}, models.NewResponse("garage_doors"))
+	if err != nil {
+		t.Fatalf("SealContents: %v", err)
+	}
+
+	next, err := k.Generate()
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	} else if err := k.Rotate(next.ID); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+
+	header, err := OpenContents(sealed, new(models.Response))
+	if err != nil || header.KeyID != old {
+		t.Errorf("Got key %s and %v opening contents sealed before rotating, want %s", header.KeyID, err, old)
+	}
+
+	if err := k.Retire(old); err != nil {
+		t.Fatalf("Retire: %v", err)
+	}
+	if _, err := OpenContents(sealed, new(models.Response)); errorCode(err, "") != models.ErrorUnknownKey {
+		t.Errorf("Got %v opening contents sealed with a retired key, want %s", err, models.ErrorUnknownKey)
+	}
+}
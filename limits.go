@@ -0,0 +1,303 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DefaultBanThreshold = 5
+	DefaultBanWindow    = time.Minute
+	DefaultBanDuration  = time.Hour
+
+	// unverifiedRate and unverifiedBurst bound how many requests that fail verification are logged
+	// and audited, for all senders together since who they claim to be from is up to whoever sent them.
+	// They are not configurable so the audit log can't be flooded by turning them off.
+	unverifiedRate  = 1
+	unverifiedBurst = 10
+	// unverifiedKey is the one key the unverified limiter counts under.
+	unverifiedKey = "unverified"
+
+	// maxBuckets is how many buckets a RateLimiter keeps before it forgets the ones that are full again.
+	maxBuckets = 1024
+)
+
+var ErrBanned = errors.New("Sender is banned.")
+
+// bucket is a token bucket, tokens are refilled continuously at the limiter's rate up to its burst.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per key, e.g. per sender or per module.  A nil RateLimiter allows
+// everything.
+type RateLimiter struct {
+	rate, burst float64
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewRateLimiter allows rate requests per second per key with bursts of up to burst requests.  It
+// returns nil, allowing everything, if rate is not positive.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the bucket of key if there is one.
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) >= maxBuckets {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets the buckets that would be full by now, they are no different from a new bucket.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Ban keeps a sender out until Until.
+type Ban struct {
+	Sender string
+	Until  time.Time
+}
+
+// BanList bans senders for a while once they fail threshold times within window, e.g. by sending
+// envelopes with contents that cannot be decrypted.  A sender is a client ID, or the address of a local
+// API client since the ID it sends is only known to be genuine once its signature checks out.  Bans
+// are saved to a file so they survive restarts.
+type BanList struct {
+	filename  string
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	lock     sync.Mutex
+	bans     map[string]time.Time
+	failures map[string][]time.Time
+}
+
+// LoadBanList reads the bans saved in filename, if it exists.  An empty filename keeps bans in memory
+// only.
+func LoadBanList(filename string, threshold int, window, duration time.Duration) (*BanList, error) {
+	if threshold <= 0 {
+		threshold = DefaultBanThreshold
+	}
+	if window <= 0 {
+		window = DefaultBanWindow
+	}
+	if duration <= 0 {
+		duration = DefaultBanDuration
+	}
+
+	b := &BanList{
+		filename:  filename,
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		bans:      make(map[string]time.Time),
+		failures:  make(map[string][]time.Time),
+	}
+	if filename == "" {
+		return b, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	bans := []Ban{}
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		b.bans[ban.Sender] = ban.Until
+	}
+	return b, nil
+}
+
+// Banned reports whether sender is currently banned.  Nobody is banned by a nil BanList.
+func (b *BanList) Banned(sender string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	until, ok := b.bans[sender]
+	return ok && time.Now().Before(until)
+}
+
+// Failure records a failure by sender and bans it if it failed too often.  It reports whether sender
+// was banned.
+func (b *BanList) Failure(sender string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, failure := range b.failures[sender] {
+		if now.Sub(failure) < b.window {
+			recent = append(recent, failure)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < b.threshold {
+		b.failures[sender] = recent
+		return false
+	}
+
+	delete(b.failures, sender)
+	b.bans[sender] = now.Add(b.duration)
+	log.WithFields(log.Fields{
+		"sender": sender,
+		"until":  b.bans[sender],
+	}).Warningln("Banned sender after repeated failures.")
+
+	b.save()
+	return true
+}
+
+// Ban bans sender for duration, or the ban list's default duration if it is not positive.
+func (b *BanList) Ban(sender string, duration time.Duration) Ban {
+	if duration <= 0 {
+		duration = b.duration
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.bans[sender] = time.Now().Add(duration)
+	b.save()
+	return Ban{Sender: sender, Until: b.bans[sender]}
+}
+
+// Unban lifts the ban on sender and forgets its failures.  It reports whether sender was banned.
+func (b *BanList) Unban(sender string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	until, ok := b.bans[sender]
+	delete(b.bans, sender)
+	delete(b.failures, sender)
+	b.save()
+	return ok && time.Now().Before(until)
+}
+
+// List returns the bans in effect, the ones ending soonest first.
+func (b *BanList) List() []Ban {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.active()
+}
+
+func (b *BanList) active() []Ban {
+	now := time.Now()
+	bans := []Ban{}
+	for sender, until := range b.bans {
+		if now.Before(until) {
+			bans = append(bans, Ban{Sender: sender, Until: until})
+		} else {
+			delete(b.bans, sender)
+		}
+	}
+
+	sort.Sort(byUntil(bans))
+	return bans
+}
+
+// save writes the bans in effect to the ban list's file.  It has to be called with the lock held.
+func (b *BanList) save() {
+	if b.filename == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(b.active(), "", "    ")
+	if err == nil {
+		err = writeFileAtomic(b.filename, data, 0600)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"fileName": b.filename,
+			"error":    err,
+		}).Errorln("Could not save the ban list.")
+	}
+}
+
+type byUntil []Ban
+
+func (b byUntil) Len() int           { return len(b) }
+func (b byUntil) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byUntil) Less(i, j int) bool { return b[i].Until.Before(b[j].Until) }
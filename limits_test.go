@@ -0,0 +1,103 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		rate        float64
+		burst       int
+		requests    int
+		wait        time.Duration
+		allowedLast bool
+	}{
+		{name: "disabled", rate: 0, burst: 1, requests: 100, allowedLast: true},
+		{name: "within the burst", rate: 1, burst: 3, requests: 3, allowedLast: true},
+		{name: "over the burst", rate: 1, burst: 3, requests: 4, allowedLast: false},
+		{name: "burst of at least one", rate: 1, burst: 0, requests: 2, allowedLast: false},
+		{name: "refilled", rate: 50, burst: 1, requests: 2, wait: 40 * time.Millisecond, allowedLast: true},
+	} {
+		limiter := NewRateLimiter(test.rate, test.burst)
+		allowed := false
+		for i := 0; i < test.requests; i++ {
+			if i == test.requests-1 {
+				time.Sleep(test.wait)
+			}
+			allowed = limiter.Allow("sender")
+		}
+
+		if allowed != test.allowedLast {
+			t.Errorf("%s: last request allowed %t, want %t", test.name, allowed, test.allowedLast)
+		}
+		if !limiter.Allow("another sender") {
+			t.Errorf("%s: another key was limited too", test.name)
+		}
+	}
+}
+
+func TestBanList(t *testing.T) {
+	filename := t.TempDir() + "/bans.json"
+	bans, err := LoadBanList(filename, 3, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadBanList: %v", err)
+	}
+
+	// the cases run in order against the same ban list
+	for _, test := range []struct {
+		name, sender string
+		action       func(sender string) bool
+		result       bool
+		banned       bool
+	}{
+		{"first failure", "a", bans.Failure, false, false},
+		{"second failure", "a", bans.Failure, false, false},
+		{"failures are counted per sender", "b", bans.Failure, false, false},
+		{"third failure", "a", bans.Failure, true, true},
+		{"others are not banned", "b", bans.Banned, false, false},
+		{"lifted", "a", bans.Unban, true, false},
+		{"failures are forgotten when lifted", "a", bans.Failure, false, false},
+		{"lifting what is not banned", "c", bans.Unban, false, false},
+	} {
+		if result := test.action(test.sender); result != test.result {
+			t.Errorf("%s: got %t, want %t", test.name, result, test.result)
+		}
+		if banned := bans.Banned(test.sender); banned != test.banned {
+			t.Errorf("%s: banned %t, want %t", test.name, banned, test.banned)
+		}
+	}
+
+	bans.Ban("d", time.Minute)
+	bans.Ban("e", -time.Minute)
+	reloaded, err := LoadBanList(filename, 3, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadBanList: %v", err)
+	}
+	if list := reloaded.List(); len(list) != 2 || list[0].Sender != "d" || list[1].Sender != "e" {
+		t.Errorf("Reloaded bans are %+v, want d followed by e which got the default duration", list)
+	}
+
+	var disabled *BanList
+	if disabled.Failure("a") || disabled.Banned("a") {
+		t.Errorf("A nil ban list banned a sender")
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+const (
+	MetricsPath = "/metrics"
+
+	// metricsContentType is the Prometheus text exposition format.
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// triggeredEvent is what the garage doors module publishes when a door is triggered.
+	triggeredEvent = "triggered"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the module request latency histogram.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// counters counts by a set of label values joined with labelSeparator.
+type counters map[string]uint64
+
+const labelSeparator = "\x00"
+
+func (c counters) inc(labels ...string) {
+	c[strings.Join(labels, labelSeparator)]++
+}
+
+// Metrics counts what igor does so it can be scraped by Prometheus.  A nil Metrics records nothing.
+type Metrics struct {
+	lock      sync.Mutex
+	envelopes uint64
+	rejected  counters
+	requests  counters
+	latencies map[string]*histogram
+	events    counters
+	triggers  counters
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		rejected:  make(counters),
+		requests:  make(counters),
+		latencies: make(map[string]*histogram),
+		events:    make(counters),
+		triggers:  make(counters),
+	}
+}
+
+// Envelope counts an envelope received from the relay server.
+func (m *Metrics) Envelope() {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.envelopes++
+}
+
+// Rejected counts an envelope that was dropped or answered with an error before reaching dispatch,
+// reason is one of the models.Error* codes or "unverified", "banned" or "rate_limited".
+func (m *Metrics) Rejected(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rejected.inc(reason)
+}
+
+// Request counts a dispatched request by its outcome and records how long it took.
+func (m *Metrics) Request(module, method, outcome string, latency time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests.inc(module, method, outcome)
+	h, ok := m.latencies[module]
+	if !ok {
+		h = new(histogram)
+		m.latencies[module] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+// Event counts an event published by a module, garage door triggers are also counted per door.
+func (m *Metrics) Event(event *models.Response) {
+	if m == nil {
+		return
+	}
+
+	name, _ := event.Data["event"].(string)
+	door, _ := event.Data["door"].(string)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.events.inc(event.Module, name)
+	if name == triggeredEvent && door != "" {
+		m.triggers.inc(event.Module, door)
+	}
+}
+
+// recordRequest counts req under its module and method only if igor knows them, whatever a client
+// makes up should not turn into a new time series.
+func (g *Gateway) recordRequest(req *models.Request, resp *models.Response, latency time.Duration) {
+	module, method := req.Module, req.Method
+	if _, up := g.modules.Get(module); !up && !g.modules.IsDown(module) && module != BuiltinModule {
+		module, method = "", ""
+	} else if _, documented := g.modules.Method(module, method); !documented && !resp.Success {
+		method = ""
+	}
+
+	g.metrics.Request(module, method, outcome(resp), latency)
+}
+
+// ServeMetrics starts serving the metrics on config.MetricsAddress over plain HTTP.  Nothing but
+// counters is exposed so it is not authenticated, bind it to an address only the scraper can reach.
+func (g *Gateway) ServeMetrics() error {
+	config := g.Config()
+
+	listener, err := net.Listen("tcp", config.MetricsAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsPath, g.handleMetrics)
+
+	g.metricsServer = &http.Server{Handler: mux}
+	go func() {
+		if err := g.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Errorln("Metrics server stopped.")
+		}
+	}()
+
+	log.WithField("address", config.MetricsAddress).Debugln("Serving metrics.")
+	return nil
+}
+
+func (g *Gateway) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	g.metrics.write(buf)
+	g.writeState(buf)
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(buf.Bytes())
+}
+
+func (m *Metrics) write(buf *bytes.Buffer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeHeader(buf, "igor_envelopes_received_total", "counter", "Envelopes received from the relay server.")
+	fmt.Fprintf(buf, "igor_envelopes_received_total %d\n", m.envelopes)
+
+	writeHeader(buf, "igor_envelopes_rejected_total", "counter", "Envelopes rejected before dispatch by reason, e.g. decrypt.")
+	writeCounters(buf, "igor_envelopes_rejected_total", m.rejected, "reason")
+
+	writeHeader(buf, "igor_module_requests_total", "counter", "Requests dispatched by module, method and outcome.")
+	writeCounters(buf, "igor_module_requests_total", m.requests, "module", "method", "outcome")
+
+	writeHeader(buf, "igor_module_request_duration_seconds", "histogram", "How long dispatched requests took by module.")
+	names := make([]string, 0, len(m.latencies))
+	for module := range m.latencies {
+		names = append(names, module)
+	}
+	sort.Strings(names)
+	for _, module := range names {
+		h := m.latencies[module]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(buf, "igor_module_request_duration_seconds_bucket{module=%s,le=%s} %d\n",
+				labelValue(module), labelValue(strconv.FormatFloat(bound, 'g', -1, 64)), h.counts[i])
+		}
+		fmt.Fprintf(buf, "igor_module_request_duration_seconds_bucket{module=%s,le=\"+Inf\"} %d\n", labelValue(module), h.count)
+		fmt.Fprintf(buf, "igor_module_request_duration_seconds_sum{module=%s} %s\n", labelValue(module), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "igor_module_request_duration_seconds_count{module=%s} %d\n", labelValue(module), h.count)
+	}
+
+	writeHeader(buf, "igor_events_total", "counter", "Events published by the modules by module and event.")
+	writeCounters(buf, "igor_events_total", m.events, "module", "event")
+
+	writeHeader(buf, "igor_garage_door_triggers_total", "counter", "Garage door triggers by module and door.")
+	writeCounters(buf, "igor_garage_door_triggers_total", m.triggers, "module", "door")
+}
+
+// writeState writes the gauges that are read from the rest of igor when scraped.
+func (g *Gateway) writeState(buf *bytes.Buffer) {
+	catalog := g.modules.Catalog()
+	subscriptions := 0
+
+	writeHeader(buf, "igor_module_up", "gauge", "Whether each known module answered its last health check.")
+	for _, entry := range catalog {
+		up := 0
+		if entry.Up {
+			up = 1
+			subscriptions++
+		}
+		fmt.Fprintf(buf, "igor_module_up{module=%s} %d\n", labelValue(entry.Name), up)
+	}
+
+	writeHeader(buf, "igor_registry_subscriptions", "gauge", "Active module subscriptions in the module registry.")
+	fmt.Fprintf(buf, "igor_registry_subscriptions %d\n", subscriptions)
+
+	writeHeader(buf, "igor_relay_connected", "gauge", "Whether igor is connected to the public relay server.")
+	fmt.Fprintf(buf, "igor_relay_connected %d\n", gauge(g.relay != nil && g.relay.Connected()))
+
+	writeHeader(buf, "igor_broker_connected", "gauge", "Whether igor is connected to the message broker.")
+	fmt.Fprintf(buf, "igor_broker_connected %d\n", gauge(g.bus.Connected()))
+}
+
+func writeHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeCounters writes c sorted by label values so scrapes are easy to compare.
+func writeCounters(buf *bytes.Buffer, name string, c counters, labels ...string) {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		pairs := make([]string, len(labels))
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs[i] = labels[i] + "=" + labelValue(value)
+		}
+		fmt.Fprintf(buf, "%s{%s} %d\n", name, strings.Join(pairs, ","), c[key])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func gauge(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
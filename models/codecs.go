@@ -0,0 +1,134 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatMsgPack = "msgpack"
+	FormatCBOR    = "cbor"
+
+	DefaultFormat = FormatJSON
+)
+
+var ErrUnknownFormat = errors.New("Unknown serialization format.")
+
+// Codec serializes Requests and Responses to and from a specific format.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[string]Codec{
+		FormatJSON:    jsonCodec{},
+		FormatMsgPack: newMsgPackCodec(),
+		FormatCBOR:    newCBORCodec(),
+	}
+)
+
+// RegisterCodec makes c available under format, replacing any codec already registered for it.
+func RegisterCodec(format string, c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[format] = c
+}
+
+// GetCodec returns the codec registered for format.  An empty format selects DefaultFormat.
+func GetCodec(format string) (Codec, error) {
+	if format == "" {
+		format = DefaultFormat
+	}
+
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[format]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return c, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// binaryCodec bridges a binary format through the JSON representation of a value so Request.Args
+// stays JSON for the modules no matter what the client sent.
+type binaryCodec struct {
+	handle codec.Handle
+}
+
+func newMsgPackCodec() binaryCodec {
+	handle := new(codec.MsgpackHandle)
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	handle.RawToString = true
+	handle.WriteExt = true
+	return binaryCodec{handle: handle}
+}
+
+func newCBORCodec() binaryCodec {
+	handle := new(codec.CborHandle)
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return binaryCodec{handle: handle}
+}
+
+func (c binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	err = codec.NewEncoderBytes(&out, c.handle).Encode(generic)
+	return out, err
+}
+
+func (c binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	var generic interface{}
+	if err := codec.NewDecoderBytes(data, c.handle).Decode(&generic); err != nil {
+		return err
+	}
+
+	bridged, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bridged, v)
+}
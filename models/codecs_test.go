@@ -0,0 +1,84 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	req, err := NewRequest("garage_doors", "Trigger", map[string]interface{}{"door": "left", "seconds": 2.5, "lights": []interface{}{true, false}})
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	resp := NewResponse("garage_doors")
+	resp.Success = true
+	resp.Data["state"] = "open"
+	resp.Data["doors"] = []interface{}{"left", "right"}
+	resp.Data["open"] = map[string]interface{}{"left": true, "seconds": 12.0}
+
+	for _, format := range []string{FormatJSON, FormatMsgPack, FormatCBOR} {
+		codec, err := GetCodec(format)
+		if err != nil {
+			t.Fatalf("%s: GetCodec: %v", format, err)
+		}
+
+		data, err := codec.Marshal(req)
+		if err != nil {
+			t.Fatalf("%s: Marshal request: %v", format, err)
+		}
+		gotReq := new(Request)
+		if err := codec.Unmarshal(data, gotReq); err != nil {
+			t.Fatalf("%s: Unmarshal request: %v", format, err)
+		}
+		if gotReq.Module != req.Module || gotReq.Method != req.Method || gotReq.Nonce != req.Nonce {
+			t.Errorf("%s: got request %+v, want %+v", format, gotReq, req)
+		}
+		if !gotReq.Timestamp.Equal(req.Timestamp) {
+			t.Errorf("%s: got timestamp %v, want %v", format, gotReq.Timestamp, req.Timestamp)
+		}
+		// modules get Args as JSON whatever the client sent
+		var gotArgs, wantArgs interface{}
+		if err := json.Unmarshal(gotReq.Args, &gotArgs); err != nil {
+			t.Errorf("%s: Args are not JSON: %v", format, err)
+		}
+		json.Unmarshal(req.Args, &wantArgs)
+		if !reflect.DeepEqual(gotArgs, wantArgs) {
+			t.Errorf("%s: got args %s, want %s", format, gotReq.Args, req.Args)
+		}
+
+		if data, err = codec.Marshal(resp); err != nil {
+			t.Fatalf("%s: Marshal response: %v", format, err)
+		}
+		gotResp := new(Response)
+		if err := codec.Unmarshal(data, gotResp); err != nil {
+			t.Fatalf("%s: Unmarshal response: %v", format, err)
+		}
+		if !reflect.DeepEqual(gotResp, resp) {
+			t.Errorf("%s: got response %+v, want %+v", format, gotResp, resp)
+		}
+	}
+}
+
+func TestGetCodecUnknownFormat(t *testing.T) {
+	if _, err := GetCodec("xml"); err != ErrUnknownFormat {
+		t.Errorf("Got %v, want ErrUnknownFormat", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package models
+
+import (
+	"strings"
+)
+
+const (
+	headerEnd       = ":"
+	headerSeparator = ";"
+	headerAssign    = "="
+
+	headerFormat = "format"
+	headerKeyID  = "key"
+
+	// LegacyKeyID names the shared key igor used before it had key IDs.  Contents sealed with it carry
+	// no key ID so clients that predate key IDs can still read them.
+	LegacyKeyID = "legacy"
+)
+
+// ContentsHeader describes how the contents of an envelope were produced.  It is written in front of
+// the base64 encoded ciphertext as "name=value;name=value:" so it is covered by the envelope
+// signature, and left off entirely when every field has its default value.
+type ContentsHeader struct {
+	Format string
+	// KeyID names the shared key the contents are encrypted with, empty means the legacy key when
+	// opening and the primary key when sealing.
+	KeyID string
+}
+
+// FormatContents prepends header to data.
+func FormatContents(header ContentsHeader, data string) string {
+	fields := []string{}
+	if header.Format != "" && header.Format != DefaultFormat {
+		fields = append(fields, headerFormat+headerAssign+header.Format)
+	}
+	if header.KeyID != "" && header.KeyID != LegacyKeyID {
+		fields = append(fields, headerKeyID+headerAssign+header.KeyID)
+	}
+
+	if len(fields) == 0 {
+		return data
+	}
+	return strings.Join(fields, headerSeparator) + headerEnd + data
+}
+
+// ParseContents splits contents into its header and the data that follows it.  Contents without a
+// header, as sent by clients that predate it, yield the default header.
+func ParseContents(contents string) (header ContentsHeader, data string) {
+	// base64 never contains the header terminator
+	end := strings.LastIndex(contents, headerEnd)
+	if end < 0 {
+		return header, contents
+	}
+
+	for _, field := range strings.Split(contents[:end], headerSeparator) {
+		pair := strings.SplitN(field, headerAssign, 2)
+		if len(pair) != 2 {
+			continue
+		}
+
+		switch pair[0] {
+		case headerFormat:
+			header.Format = pair[1]
+		case headerKeyID:
+			header.KeyID = pair[1]
+		}
+	}
+
+	return header, contents[end+len(headerEnd):]
+}
@@ -0,0 +1,75 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package models
+
+import (
+	"testing"
+)
+
+func TestFormatParseContents(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		header    ContentsHeader
+		data      string
+		formatted string
+	}{
+		{"default header is left off", ContentsHeader{}, "c2VjcmV0", "c2VjcmV0"},
+		{"default format is left off", ContentsHeader{Format: DefaultFormat}, "c2VjcmV0", "c2VjcmV0"},
+		{"legacy key is left off", ContentsHeader{KeyID: LegacyKeyID}, "c2VjcmV0", "c2VjcmV0"},
+		{"format", ContentsHeader{Format: FormatCBOR}, "c2VjcmV0", "format=cbor:c2VjcmV0"},
+		{"key", ContentsHeader{KeyID: "0a1b2c3d"}, "c2VjcmV0", "key=0a1b2c3d:c2VjcmV0"},
+		{"format and key", ContentsHeader{Format: FormatMsgPack, KeyID: "0a1b2c3d"}, "c2VjcmV0", "format=msgpack;key=0a1b2c3d:c2VjcmV0"},
+		{"no data", ContentsHeader{KeyID: "0a1b2c3d"}, "", "key=0a1b2c3d:"},
+	} {
+		formatted := FormatContents(test.header, test.data)
+		if formatted != test.formatted {
+			t.Errorf("%s: formatted %q, want %q", test.name, formatted, test.formatted)
+		}
+
+		header, data := ParseContents(formatted)
+		want := test.header
+		if want.Format == DefaultFormat {
+			want.Format = ""
+		}
+		if want.KeyID == LegacyKeyID {
+			want.KeyID = ""
+		}
+		if header != want || data != test.data {
+			t.Errorf("%s: parsed %+v and %q, want %+v and %q", test.name, header, data, want, test.data)
+		}
+	}
+}
+
+func TestParseContents(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		contents string
+		header   ContentsHeader
+		data     string
+	}{
+		{"contents from a client without headers", "c2VjcmV0", ContentsHeader{}, "c2VjcmV0"},
+		{"unknown fields are skipped", "zip=1;key=0a1b2c3d:c2VjcmV0", ContentsHeader{KeyID: "0a1b2c3d"}, "c2VjcmV0"},
+		{"fields without a value are skipped", "format;key=0a1b2c3d:c2VjcmV0", ContentsHeader{KeyID: "0a1b2c3d"}, "c2VjcmV0"},
+		{"empty header", ":c2VjcmV0", ContentsHeader{}, "c2VjcmV0"},
+	} {
+		header, data := ParseContents(test.contents)
+		if header != test.header || data != test.data {
+			t.Errorf("%s: got %+v and %q, want %+v and %q", test.name, header, data, test.header, test.data)
+		}
+	}
+}
@@ -18,18 +18,59 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package models
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"time"
+)
+
+const nonceLen = 16
+
+// Error codes carried in the "code" field of an error response's Data.
+const (
+	ErrorDecrypt       = "decrypt"
+	ErrorUnknownKey    = "unknown_key"
+	ErrorDecode        = "decode"
+	ErrorExpired       = "expired"
+	ErrorStale         = "stale"
+	ErrorReplayed      = "replayed"
+	ErrorUnknownModule = "unknown_module"
+	ErrorUnknownMethod = "unknown_method"
+	ErrorForbidden     = "forbidden"
+	ErrorRateLimited   = "rate_limited"
+	ErrorInvalidArgs   = "invalid_args"
+	ErrorUnavailable   = "unavailable"
+	ErrorTimeout       = "timeout"
+	ErrorRPC           = "rpc"
+	ErrorMarshal       = "marshal"
 )
 
 type Request struct {
 	Module string
 	Method string
 	Args   json.RawMessage
+	// Timestamp and Nonce let igor reject stale or replayed requests.
+	Timestamp time.Time
+	Nonce     string
 }
 
 func NewRequest(module, method string, args interface{}) (*Request, error) {
 	argData, err := json.Marshal(args)
-	return &Request{Module: module, Method: method, Args: argData}, err
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := NewNonce()
+	return &Request{Module: module, Method: method, Args: argData, Timestamp: time.Now().UTC(), Nonce: nonce}, err
+}
+
+// NewNonce returns a random, base64 encoded value suitable for Request.Nonce.
+func NewNonce() (string, error) {
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
 }
 
 type Response struct {
@@ -42,7 +83,7 @@ func NewResponse(module string) *Response {
 	return &Response{Module: module, Success: false, Broadcast: false, Data: make(map[string]interface{})}
 }
 
-func NewErrorResponse(module, method, errorMsg string) *Response {
+func NewErrorResponse(module, method, code, errorMsg string) *Response {
 	return &Response{Module: module, Success: false, Broadcast: false,
-		Data: map[string]interface{}{"method": method, "message": errorMsg}}
+		Data: map[string]interface{}{"method": method, "code": code, "message": errorMsg}}
 }
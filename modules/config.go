@@ -0,0 +1,117 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FieldError is a problem with a single field of a configuration file.  Field is named the way it is
+// written in the file.
+type FieldError struct {
+	Field, Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ConfigErrors collects every problem found while validating a configuration so they can be reported
+// at once.
+type ConfigErrors []*FieldError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Add records a problem with field.
+func (e *ConfigErrors) Add(field, message string) {
+	*e = append(*e, &FieldError{Field: field, Message: message})
+}
+
+// Err returns e as an error, nil if no problems were found.
+func (e ConfigErrors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// CheckDir records a problem unless dir is an existing directory.
+func (e *ConfigErrors) CheckDir(field, dir string) {
+	if dir == "" {
+		e.Add(field, "Required.")
+	} else if info, err := os.Stat(dir); err != nil {
+		e.Add(field, "Directory cannot be used: "+err.Error())
+	} else if !info.IsDir() {
+		e.Add(field, "Not a directory: "+dir)
+	}
+}
+
+// CheckFile records a problem unless filename is an existing file.
+func (e *ConfigErrors) CheckFile(field, filename string) {
+	if filename == "" {
+		e.Add(field, "Required.")
+	} else if info, err := os.Stat(filename); err != nil {
+		e.Add(field, "File cannot be used: "+err.Error())
+	} else if info.IsDir() {
+		e.Add(field, "Not a file: "+filename)
+	}
+}
+
+// CheckParent records a problem unless the directory filename will be created in exists.
+func (e *ConfigErrors) CheckParent(field, filename string) {
+	e.CheckDir(field, filepath.Dir(filename))
+}
+
+// NormalizeDir cleans dir and ends it with a slash since socket names are appended to directories
+// without one.
+func NormalizeDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	dir = filepath.Clean(dir)
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return dir
+}
+
+// Check normalizes SocketDir and records any problems with the module's name and socket directory.
+func (c *BaseConfig) Check(errs *ConfigErrors) {
+	switch {
+	case c.Name == "":
+		errs.Add("name", "Required.")
+	case strings.ContainsRune(c.Name, filepath.Separator):
+		errs.Add("name", "Must not contain "+string(filepath.Separator)+", it names the module's socket.")
+	case c.Name == EventSocket:
+		errs.Add("name", "Reserved for igor's event socket.")
+	case c.Name == BuiltinModule:
+		errs.Add("name", "Reserved for igor's built-in methods.")
+	}
+
+	c.SocketDir = NormalizeDir(c.SocketDir)
+	errs.CheckDir("socketDir", c.SocketDir)
+}
@@ -0,0 +1,53 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package modules
+
+import (
+	"testing"
+)
+
+func TestBaseConfigCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, test := range []struct {
+		name, module, socketDir string
+		fields                  []string
+	}{
+		{"valid", "garage_doors", dir, nil},
+		{"no name", "", dir, []string{"name"}},
+		{"path in name", "doors/left", dir, []string{"name"}},
+		{"event socket", EventSocket, dir, []string{"name"}},
+		{"built-in module", BuiltinModule, dir, []string{"name"}},
+		{"no socket directory", "garage_doors", "", []string{"socketDir"}},
+		{"missing socket directory", "garage_doors", dir + "/missing", []string{"socketDir"}},
+	} {
+		config := &BaseConfig{Name: test.module, SocketDir: test.socketDir}
+		errs := ConfigErrors{}
+		config.Check(&errs)
+
+		if len(errs) != len(test.fields) {
+			t.Errorf("%s: got %v, want problems with %v", test.name, errs.Err(), test.fields)
+			continue
+		}
+		for i, field := range test.fields {
+			if errs[i].Field != field {
+				t.Errorf("%s: got a problem with %s, want %s", test.name, errs[i].Field, field)
+			}
+		}
+	}
+}
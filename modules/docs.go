@@ -0,0 +1,161 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package modules
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+// Argument types, an argument with any other type is not checked.
+const (
+	TypeString  = "string"
+	TypeBoolean = "boolean"
+	TypeNumber  = "number"
+	TypeInteger = "integer"
+	TypeObject  = "object"
+	TypeArray   = "array"
+)
+
+func init() {
+	// MethodDocs travel inside Response.Data over RPC
+	gob.Register([]MethodDoc{})
+}
+
+// MethodDoc describes a method a module serves to clients.
+type MethodDoc struct {
+	Name  string   `json:"methodName"`
+	Human string   `json:"human"`
+	Args  []ArgDoc `json:"args"`
+}
+
+// ArgDoc describes a single argument of a method.  Options, if any, are the only values a string
+// argument accepts and Min and Max, if set, bound a numeric argument.
+type ArgDoc struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Options  []string `json:"options,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Required bool     `json:"required"`
+}
+
+// Bound is a convenience for setting ArgDoc.Min and ArgDoc.Max.
+func Bound(v float64) *float64 {
+	return &v
+}
+
+// NewDocsResponse answers a call to Docs with methods.
+func NewDocsResponse(module string, methods ...MethodDoc) *models.Response {
+	response := models.NewResponse(module)
+	response.Success = true
+	response.Data[DocsKey] = methods
+	return response
+}
+
+// Validate checks that args, a JSON object, holds every required argument of m, no arguments m does
+// not declare and that every value fits its ArgDoc.  Names match case insensitively, like
+// encoding/json matches them to struct fields.
+func (m MethodDoc) Validate(args json.RawMessage) error {
+	values := make(map[string]interface{})
+	if len(args) > 0 && string(args) != "null" {
+		if err := json.Unmarshal(args, &values); err != nil {
+			return fmt.Errorf("Arguments to %s must be a JSON object.", m.Name)
+		}
+	}
+
+	declared := make(map[string]ArgDoc, len(m.Args))
+	for _, arg := range m.Args {
+		declared[strings.ToLower(arg.Name)] = arg
+	}
+
+	given := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		if _, ok := declared[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("Unknown argument %s.", name)
+		}
+		given[strings.ToLower(name)] = value
+	}
+
+	for key, arg := range declared {
+		value, ok := given[key]
+		if !ok || value == nil {
+			if arg.Required {
+				return fmt.Errorf("Argument %s is required.", arg.Name)
+			}
+			continue
+		}
+
+		if err := arg.check(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a ArgDoc) check(value interface{}) error {
+	switch a.Type {
+	case TypeString:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("Argument %s must be a string.", a.Name)
+		}
+		if len(a.Options) > 0 && !contains(a.Options, s) {
+			return fmt.Errorf("Argument %s must be one of %s.", a.Name, strings.Join(a.Options, ", "))
+		}
+	case TypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("Argument %s must be a boolean.", a.Name)
+		}
+	case TypeNumber, TypeInteger:
+		n, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("Argument %s must be a number.", a.Name)
+		} else if a.Type == TypeInteger && n != math.Trunc(n) {
+			return fmt.Errorf("Argument %s must be an integer.", a.Name)
+		}
+		if a.Min != nil && n < *a.Min {
+			return fmt.Errorf("Argument %s must be at least %v.", a.Name, *a.Min)
+		} else if a.Max != nil && n > *a.Max {
+			return fmt.Errorf("Argument %s must be at most %v.", a.Name, *a.Max)
+		}
+	case TypeObject:
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fmt.Errorf("Argument %s must be an object.", a.Name)
+		}
+	case TypeArray:
+		if _, ok := value.([]interface{}); !ok {
+			return fmt.Errorf("Argument %s must be an array.", a.Name)
+		}
+	}
+	return nil
+}
+
+func contains(options []string, s string) bool {
+	for _, option := range options {
+		if option == s {
+			return true
+		}
+	}
+	return false
+}
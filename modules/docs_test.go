@@ -0,0 +1,69 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package modules
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMethodDocValidate(t *testing.T) {
+	trigger := MethodDoc{Name: "Trigger", Args: []ArgDoc{
+		{Name: "door", Type: TypeString, Options: []string{"left", "right"}, Required: true},
+		{Name: "seconds", Type: TypeInteger, Min: Bound(1), Max: Bound(30)},
+		{Name: "level", Type: TypeNumber},
+		{Name: "force", Type: TypeBoolean},
+		{Name: "schedule", Type: TypeObject},
+		{Name: "doors", Type: TypeArray},
+		{Name: "note", Type: "color"},
+	}}
+
+	for _, test := range []struct {
+		name string
+		args string
+		ok   bool
+	}{
+		{"required argument", `{"door":"left"}`, true},
+		{"every argument", `{"door":"right","seconds":5,"level":0.5,"force":true,"schedule":{},"doors":[],"note":1}`, true},
+		{"names match case insensitively", `{"Door":"left","SECONDS":1}`, true},
+		{"null optional argument", `{"door":"left","seconds":null}`, true},
+		{"no arguments", ``, false},
+		{"null arguments", `null`, false},
+		{"not an object", `["left"]`, false},
+		{"missing required argument", `{"seconds":5}`, false},
+		{"null required argument", `{"door":null}`, false},
+		{"unknown argument", `{"door":"left","speed":2}`, false},
+		{"option not offered", `{"door":"middle"}`, false},
+		{"string expected", `{"door":1}`, false},
+		{"integer expected", `{"door":"left","seconds":1.5}`, false},
+		{"number expected", `{"door":"left","level":"high"}`, false},
+		{"below the minimum", `{"door":"left","seconds":0}`, false},
+		{"above the maximum", `{"door":"left","seconds":31}`, false},
+		{"boolean expected", `{"door":"left","force":"yes"}`, false},
+		{"object expected", `{"door":"left","schedule":[]}`, false},
+		{"array expected", `{"door":"left","doors":{}}`, false},
+	} {
+		if err := trigger.Validate(json.RawMessage(test.args)); (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %t", test.name, err, test.ok)
+		}
+	}
+
+	if err := (MethodDoc{Name: "Status"}).Validate(nil); err != nil {
+		t.Errorf("Method without arguments: got %v", err)
+	}
+}
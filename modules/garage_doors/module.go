@@ -22,6 +22,7 @@ import (
 	"net"
 	"net/rpc"
 	"os"
+	"sort"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -36,6 +37,38 @@ type Config struct {
 	TriggerTime, ForceTriggerTime time.Duration
 }
 
+// Validate normalizes the socket directory and checks every field, problems are returned as
+// modules.ConfigErrors.
+func (c *Config) Validate() error {
+	errs := modules.ConfigErrors{}
+	c.BaseConfig.Check(&errs)
+
+	if len(c.Pins) == 0 {
+		errs.Add("pins", "At least one door must be configured.")
+	}
+	labels := make([]string, 0, len(c.Pins))
+	for label := range c.Pins {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if label == "" {
+			errs.Add("pins", "Door labels must not be empty.")
+		} else if c.Pins[label] < 0 {
+			errs.Add("pins."+label, "Must be a GPIO pin number.")
+		}
+	}
+
+	if c.TriggerTime <= 0 {
+		errs.Add("triggerTime", "Must be positive.")
+	}
+	if c.ForceTriggerTime < c.TriggerTime {
+		errs.Add("forceTriggerTime", "Must not be shorter than triggerTime.")
+	}
+
+	return errs.Err()
+}
+
 type GarageDoors struct {
 	modules.BaseModule
 	doors map[string]*GarageDoorController
@@ -44,10 +77,11 @@ type GarageDoors struct {
 func (gd *GarageDoors) Configure(req models.Request, response *models.Response) error {
 	config := new(Config)
 	if err := json.Unmarshal(req.Args, config); err != nil {
-		response.Success = false
-		response.Data["message"] = "Error parsing arguments."
 		log.Errorln("Could not unmarshal arguments.")
-		return nil
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
 	}
 
 	gd.Name = config.Name
@@ -60,31 +94,32 @@ func (gd *GarageDoors) Configure(req models.Request, response *models.Response)
 		}
 		gd.doors[label] = controller
 	}
+	gd.Methods = gd.methods()
 
 	return nil
 }
 
-const triggerDoc = `{
-    "human": "Trigger triggers a garage door normally or forced (trigger lasts until door is completely open or closed).",
-    "methodName": "trigger",
-    "args": [
-        {"name": "door", "type": "string", "options": %v, "required": true},
-        {"name": "force", "type": "boolean", "required": false}
-    ]
-}`
-
-func (gd *GarageDoors) Docs(req models.Request, response *models.Response) error {
-	response = models.NewResponse(gd.Name)
-	response.Success = true
-	response.Data["documentation"] = triggerDoc
-
-	return nil
+func (gd *GarageDoors) methods() []modules.MethodDoc {
+	doors := make([]string, 0, len(gd.doors))
+	for label := range gd.doors {
+		doors = append(doors, label)
+	}
+	sort.Strings(doors)
+
+	return []modules.MethodDoc{{
+		Name:  "Trigger",
+		Human: "Trigger triggers a garage door normally or forced (trigger lasts until door is completely open or closed).",
+		Args: []modules.ArgDoc{
+			{Name: "door", Type: modules.TypeString, Options: doors, Required: true},
+			{Name: "force", Type: modules.TypeBoolean, Required: false},
+		},
+	}}
 }
 
 func (gd *GarageDoors) Trigger(req models.Request, response *models.Response) error {
 	log.Debugln("Trigger called.")
 
-	response = models.NewResponse(gd.Name)
+	*response = *models.NewResponse(gd.Name)
 
 	args := new(models.TriggerArgs)
 	if err := json.Unmarshal(req.Args, args); err != nil {
@@ -101,7 +136,16 @@ func (gd *GarageDoors) Trigger(req models.Request, response *models.Response) er
 		return nil
 	}
 
-	if err := gd.doors[args.Door].Trigger(args.Force); err != nil {
+	door, ok := gd.doors[args.Door]
+	if !ok {
+		response.Success = false
+		response.Data["door"] = args.Door
+		response.Data["message"] = "Unknown door."
+		log.WithFields(response.Data).Errorln("Door not found.")
+		return nil
+	}
+
+	if err := door.Trigger(args.Force); err != nil {
 		response.Success = false
 		response.Data["door"] = args.Door
 		response.Data["force"] = args.Force
@@ -116,6 +160,14 @@ func (gd *GarageDoors) Trigger(req models.Request, response *models.Response) er
 	response.Data["message"] = "Garage door successfully triggered."
 	log.WithFields(response.Data).Debugln("Door successfully triggered.")
 
+	event := models.NewResponse(gd.Name)
+	event.Success = true
+	event.Data["door"] = args.Door
+	event.Data["event"] = "triggered"
+	if err := gd.PublishEvent(event); err != nil {
+		log.WithError(err).Warnln("Could not publish trigger event.")
+	}
+
 	return nil
 }
 
@@ -129,7 +181,7 @@ func ServeRPC(m *GarageDoors) error {
 	}
 	defer os.Remove(m.SocketDir + m.Name)
 
-	os.Chmod(m.SocketDir+m.Name, 0666)
+	os.Chmod(m.SocketDir+m.Name, 0660)
 
 	server := rpc.NewServer()
 	server.RegisterName(m.Name, m)
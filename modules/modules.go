@@ -18,18 +18,51 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package modules
 
 import (
+	"encoding/json"
 	"net"
 	"net/rpc"
+	"sync"
 
 	"github.com/alittlebrighter/igor/models"
 )
 
 const (
 	ModulePrefix = "igor.module."
+	// BuiltinModule is the name requests use to reach igor itself, no module can take it.
+	BuiltinModule = "igor"
+	// PingMethod is answered by every module that embeds BaseModule so igor can check it is alive.
+	PingMethod = "Ping"
+	// DocsMethod is called by igor when it subscribes a module, the module's MethodDocs are expected
+	// under DocsKey in the Data of the response.
+	DocsMethod = "Docs"
+	DocsKey    = "methods"
+	// EventTokenMethod hands the module the token it publishes events with, the token tells igor which
+	// module an event came from.  It is called by igor whenever it subscribes the module.
+	EventTokenMethod = "SetEventToken"
+
+	// EventSubject is where igor picks up events to broadcast to every paired client, modules reach it
+	// through the EventSocket igor serves in the module socket directory.
+	EventSubject = "igor.events"
+	EventSocket  = "igor.events"
+	EventService = "Events"
 )
 
+// Internal reports whether method is only meant to be called by igor itself, clients can never call
+// it.
+func Internal(method string) bool {
+	return method == PingMethod || method == DocsMethod || method == EventTokenMethod
+}
+
+// PublishArgs are the arguments of the Publish method served on the EventSocket.  igor fills in the
+// module of the event from Token, whatever the event says.
+type PublishArgs struct {
+	Token string
+	Event models.Response
+}
+
 type Module interface {
 	Docs(models.Request, *models.Response) error
+	Ping(models.Request, *models.Response) error
 }
 
 type BaseConfig struct {
@@ -38,6 +71,61 @@ type BaseConfig struct {
 
 type BaseModule struct {
 	Name, SocketDir string
+	// Methods are declared once by the module, they are served by Docs and igor checks the arguments of
+	// every request against them.
+	Methods []MethodDoc
+
+	eventLock  sync.Mutex
+	eventToken string
+}
+
+func (m *BaseModule) Docs(req models.Request, response *models.Response) error {
+	*response = *NewDocsResponse(m.Name, m.Methods...)
+	return nil
+}
+
+// SetEventToken keeps the token igor passes as a JSON string in the arguments.
+func (m *BaseModule) SetEventToken(req models.Request, response *models.Response) error {
+	token := ""
+	if err := json.Unmarshal(req.Args, &token); err != nil {
+		return err
+	}
+
+	m.eventLock.Lock()
+	m.eventToken = token
+	m.eventLock.Unlock()
+
+	*response = *models.NewResponse(m.Name)
+	response.Success = true
+	return nil
+}
+
+// PublishEvent broadcasts an unsolicited event, e.g. a door opening, to every client paired with igor.
+// It fails until igor has subscribed the module.
+func (m *BaseModule) PublishEvent(event *models.Response) error {
+	m.eventLock.Lock()
+	token := m.eventToken
+	m.eventLock.Unlock()
+
+	return PublishEvent(m.SocketDir, token, event)
+}
+
+func (m *BaseModule) Ping(req models.Request, response *models.Response) error {
+	*response = *models.NewResponse(m.Name)
+	response.Success = true
+	return nil
+}
+
+// PublishEvent hands event to the igor serving the module sockets in socketDir for broadcasting, token
+// is the one igor handed the module with EventTokenMethod.
+func PublishEvent(socketDir, token string, event *models.Response) error {
+	client, err := rpc.Dial("unix", socketDir+EventSocket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Call(EventService+".Publish", PublishArgs{Token: token, Event: *event}, new(bool))
 }
 
 func Serve(m Module, socketDir, mName string) error {
@@ -0,0 +1,359 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+
+	"github.com/alittlebrighter/igor/modules"
+)
+
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	pingTimeout                = 2 * time.Second
+)
+
+var ErrUnknownModule = errors.New("Unknown module.")
+
+// ModuleRegistry owns the SubscriptionClient of every module igor is connected to.  It is safe for
+// concurrent use.
+type ModuleRegistry struct {
+	bus       MessageBus
+	socketDir string
+	audit     *AuditLog
+	// relayToken marks the requests the gateway forwards, it has recorded them already
+	relayToken string
+	closed     chan struct{}
+
+	lock    sync.RWMutex
+	modules map[string]*moduleEntry
+}
+
+// moduleEntry tracks a single module, sub is nil while the module is down.  docs are kept while it is
+// down so the catalog still lists it.  token identifies the module's events.
+type moduleEntry struct {
+	sub     *SubscriptionClient
+	docs    []modules.MethodDoc
+	token   string
+	backoff *Backoff
+	retryAt time.Time
+}
+
+// NewModuleRegistry returns a registry subscribing the modules serving in socketDir to bus, every
+// request they answer is recorded in audit.
+func NewModuleRegistry(bus MessageBus, socketDir string, audit *AuditLog) *ModuleRegistry {
+	relayToken, err := randomToken()
+	if err != nil {
+		logger.WithError(err).Errorln("Could not generate relay token, requests from the gateway will be recorded twice.")
+	}
+
+	return &ModuleRegistry{
+		bus:        bus,
+		socketDir:  socketDir,
+		audit:      audit,
+		relayToken: relayToken,
+		closed:     make(chan struct{}),
+		modules:    make(map[string]*moduleEntry),
+	}
+}
+
+func (r *ModuleRegistry) SocketDir() string {
+	return r.socketDir
+}
+
+// RelayToken is sent along with the requests the gateway forwards to the modules so their
+// subscriptions leave recording them to the gateway.
+func (r *ModuleRegistry) RelayToken() string {
+	return r.relayToken
+}
+
+// Add subscribes the module serving on the socket called name, replacing any previous subscription to
+// a module of the same name.
+func (r *ModuleRegistry) Add(name string) error {
+	subClient, err := SubscribeModule(r.bus, r.socketDir, name, r.audit, r.relayToken)
+	if err != nil {
+		return err
+	}
+	docs, token := fetchDocs(subClient), handOutEventToken(subClient)
+
+	r.lock.Lock()
+	previous := r.modules[name]
+	r.modules[name] = &moduleEntry{sub: subClient, docs: docs, token: token, backoff: NewBackoff()}
+	r.lock.Unlock()
+
+	if previous != nil && previous.sub != nil {
+		previous.sub.Close()
+	}
+	return nil
+}
+
+// Remove unsubscribes the module called name and closes its RPC client.
+func (r *ModuleRegistry) Remove(name string) error {
+	r.lock.Lock()
+	entry, ok := r.modules[name]
+	delete(r.modules, name)
+	r.lock.Unlock()
+
+	if !ok {
+		return ErrUnknownModule
+	} else if entry.sub == nil {
+		return nil
+	}
+	return entry.sub.Close()
+}
+
+// Get returns the subscription of the module called name if it is known and up.
+func (r *ModuleRegistry) Get(name string) (*SubscriptionClient, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	entry, ok := r.modules[name]
+	if !ok || entry.sub == nil {
+		return nil, false
+	}
+	return entry.sub, true
+}
+
+// IsDown reports whether the module called name is known but failed its last health check.
+func (r *ModuleRegistry) IsDown(name string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	entry, ok := r.modules[name]
+	return ok && entry.sub == nil
+}
+
+// List returns the names of all known modules, up or down, in alphabetical order.
+func (r *ModuleRegistry) List() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.modules))
+	for name := range r.modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Monitor pings every module each interval until the registry is closed.  A module that does not
+// answer is marked down and redialed with backoff until it comes back, then it is subscribed again.
+func (r *ModuleRegistry) Monitor(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.checkModules()
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *ModuleRegistry) checkModules() {
+	log := logger.WithField("func", "ModuleRegistry.checkModules")
+
+	for _, name := range r.List() {
+		r.lock.RLock()
+		entry, ok := r.modules[name]
+		r.lock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if sub := entry.sub; sub != nil {
+			err := sub.Ping(pingTimeout)
+			if err == nil {
+				continue
+			}
+
+			r.lock.Lock()
+			if r.modules[name] == entry && entry.sub == sub {
+				entry.sub = nil
+				entry.retryAt = time.Now().Add(entry.backoff.Next())
+			}
+			r.lock.Unlock()
+			sub.Close()
+
+			log.WithFields(logger.Fields{
+				"module": name,
+				"error":  err,
+			}).Warnln("Module is down.")
+			continue
+		}
+
+		if time.Now().Before(entry.retryAt) {
+			continue
+		}
+
+		sub, err := SubscribeModule(r.bus, r.socketDir, name, r.audit, r.relayToken)
+		var docs []modules.MethodDoc
+		var token string
+		if err == nil {
+			// the module may have been upgraded while it was down
+			docs, token = fetchDocs(sub), handOutEventToken(sub)
+		}
+
+		r.lock.Lock()
+		current := r.modules[name] == entry
+		if current && err == nil {
+			entry.sub = sub
+			entry.docs = docs
+			entry.token = token
+			entry.backoff.Reset()
+		} else if current {
+			entry.retryAt = time.Now().Add(entry.backoff.Next())
+		}
+		r.lock.Unlock()
+
+		switch {
+		case err != nil:
+			log.WithFields(logger.Fields{
+				"module": name,
+				"retry":  entry.retryAt,
+				"error":  err,
+			}).Debugln("Module is still down.")
+		case !current:
+			// the module was removed or replaced while it was being redialed
+			sub.Close()
+		default:
+			log.WithField("module", name).Infoln("Module is back up.")
+		}
+	}
+}
+
+// Catalog lists every known module, up or down, with the methods it documented in alphabetical order.
+func (r *ModuleRegistry) Catalog() []CatalogEntry {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	catalog := make([]CatalogEntry, 0, len(r.modules))
+	for name, entry := range r.modules {
+		catalog = append(catalog, CatalogEntry{Name: name, Up: entry.sub != nil, Methods: entry.docs})
+	}
+	sort.Sort(byName(catalog))
+	return catalog
+}
+
+// Method returns the documentation of method as declared by the module called name.
+func (r *ModuleRegistry) Method(name, method string) (modules.MethodDoc, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if entry, ok := r.modules[name]; ok {
+		for _, doc := range entry.docs {
+			if doc.Name == method {
+				return doc, true
+			}
+		}
+	}
+	return modules.MethodDoc{}, false
+}
+
+// EventSender returns the name of the module token was handed to.
+func (r *ModuleRegistry) EventSender(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name, entry := range r.modules {
+		if subtle.ConstantTimeCompare([]byte(entry.token), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// handOutEventToken gives the module a new random event token and returns it, or an empty token if the
+// module cannot take one, e.g. because it was built before event tokens existed.
+func handOutEventToken(sub *SubscriptionClient) string {
+	token, err := randomToken()
+	if err != nil {
+		logger.WithError(err).Errorln("Could not generate event token.")
+		return ""
+	}
+
+	if err := sub.SetEventToken(token, pingTimeout); err != nil {
+		logger.WithFields(logger.Fields{
+			"module": sub.Module,
+			"error":  err,
+		}).Warnln("Could not hand the module an event token, it cannot publish events.")
+		return ""
+	}
+	return token
+}
+
+func randomToken() (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// Documented reports whether the module called name declared its methods, only those may be called.
+func (r *ModuleRegistry) Documented(name string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	entry, ok := r.modules[name]
+	return ok && len(entry.docs) > 0
+}
+
+func fetchDocs(sub *SubscriptionClient) []modules.MethodDoc {
+	docs, err := sub.Docs(pingTimeout)
+	if err != nil {
+		logger.WithFields(logger.Fields{
+			"module": sub.Module,
+			"error":  err,
+		}).Warnln("Could not get module docs, it will be missing from the catalog.")
+	}
+	return docs
+}
+
+// Close removes every module from the registry and stops monitoring them.
+func (r *ModuleRegistry) Close() {
+	r.lock.Lock()
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	r.lock.Unlock()
+
+	for _, name := range r.List() {
+		r.Remove(name)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	sModels "github.com/alittlebrighter/switchboard/models"
+	"github.com/alittlebrighter/switchboard/util"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	ErrNotConnected = errors.New("Not connected to the relay server.")
+	ErrRelayClosed  = errors.New("Relay connection is closed.")
+	ErrHostChanged  = errors.New("Relay server changed while connecting.")
+)
+
+// Relay is a connection to a public switchboard server, the gateway receives envelopes and sends
+// its replies over it.  RelayConn is the one igor uses.
+type Relay interface {
+	Incoming() <-chan *sModels.Envelope
+	SendMessage(env *sModels.Envelope) error
+	SetHost(host string)
+	Connected() bool
+	Close() error
+}
+
+// RelayConn keeps a websocket open to the public switchboard server, reopening it with backoff
+// whenever it drops.  Envelopes received over any of the sockets it opens are delivered on a single
+// channel so readers never notice a reconnect.
+type RelayConn struct {
+	id       *uuid.UUID
+	incoming chan *sModels.Envelope
+	closed   chan struct{}
+
+	lock   sync.RWMutex
+	host   string
+	socket *websocket.Conn
+}
+
+func NewRelayConn(id *uuid.UUID, host string) *RelayConn {
+	return &RelayConn{
+		id:       id,
+		host:     host,
+		incoming: make(chan *sModels.Envelope, 10),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Incoming returns the channel envelopes from the relay are delivered on.  It is closed after Close.
+func (r *RelayConn) Incoming() <-chan *sModels.Envelope {
+	return r.incoming
+}
+
+func (r *RelayConn) Connected() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.socket != nil
+}
+
+// SetHost switches to the relay server at host.  The current socket is closed so Run reconnects to the
+// new server right away.
+func (r *RelayConn) SetHost(host string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.host = host
+	if r.socket != nil {
+		r.socket.Close()
+	}
+}
+
+// Run opens the socket and reads from it, reconnecting whenever it is lost, until Close is called.
+func (r *RelayConn) Run() {
+	defer close(r.incoming)
+
+	backoff := NewBackoff()
+	for {
+		host := r.currentHost()
+		log := logger.WithFields(logger.Fields{"func": "RelayConn.Run", "relayHost": host})
+
+		socket, err := r.open(host)
+		if err != nil {
+			delay := backoff.Next()
+			log.WithFields(logger.Fields{
+				"error": err,
+				"retry": delay,
+			}).Warnln("Could not connect to relay server.")
+
+			select {
+			case <-time.After(delay):
+				continue
+			case <-r.closed:
+				return
+			}
+		}
+
+		backoff.Reset()
+		log.Infoln("Connected to relay server.")
+
+		err = util.ReadFromWebSocket(socket, r.processMsg)
+
+		r.lock.Lock()
+		r.socket = nil
+		r.lock.Unlock()
+
+		select {
+		case <-r.closed:
+			log.Infoln("Disconnected from relay server.")
+			return
+		default:
+			log.WithError(err).Warnln("Lost connection to relay server.")
+		}
+	}
+}
+
+func (r *RelayConn) currentHost() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.host
+}
+
+func (r *RelayConn) open(host string) (*websocket.Conn, error) {
+	// origin can be a bogus URL so we'll just use it to identify the connection on the server
+	socket, err := websocket.Dial("ws://"+host+"/socket", "", "http://"+r.id.String())
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	select {
+	case <-r.closed:
+		socket.Close()
+		return nil, ErrRelayClosed
+	default:
+	}
+
+	if host != r.host {
+		socket.Close()
+		return nil, ErrHostChanged
+	}
+
+	r.socket = socket
+	return socket, nil
+}
+
+func (r *RelayConn) processMsg(data []byte) {
+	env := new(sModels.Envelope)
+	if err := util.Unmarshal(data, env); err != nil {
+		logger.WithError(err).Errorln("Could not parse envelope from relay server.")
+		return
+	}
+	r.incoming <- env
+}
+
+func (r *RelayConn) SendMessage(env *sModels.Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if r.socket == nil {
+		return ErrNotConnected
+	}
+	return websocket.Message.Send(r.socket, data)
+}
+
+// Close stops reconnecting and closes the current socket.
+func (r *RelayConn) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	select {
+	case <-r.closed:
+		return nil
+	default:
+		close(r.closed)
+	}
+
+	if r.socket != nil {
+		return r.socket.Close()
+	}
+	return nil
+}
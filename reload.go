@@ -0,0 +1,75 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// liveFields are the Config fields Reload applies to a running gateway, changes to any other field
+// only take effect after a restart.
+var liveFields = map[string]bool{
+	"LogLevel":       true,
+	"PublicRelay":    true,
+	"ResponseTTL":    true,
+	"DefaultTimeout": true,
+	"Timeouts":       true,
+	"ACL":            true,
+}
+
+// Reload applies the fields of config that can change while igor is running: the log level, the
+// module timeouts, the ACL and the relay server, which is reconnected to if it changed.  It returns
+// the names of the fields that changed but need a restart, those keep their current values.  Nothing
+// is applied if config is invalid.
+func (g *Gateway) Reload(config *Config) ([]string, error) {
+	level, err := config.Level()
+	if err != nil {
+		return nil, err
+	}
+	acl, err := NewACL(config.ACL)
+	if err != nil {
+		return nil, err
+	}
+
+	g.configLock.Lock()
+	previous := g.config
+	applied := *previous
+	restart := []string{}
+
+	current, next := reflect.ValueOf(&applied).Elem(), reflect.ValueOf(config).Elem()
+	for i := 0; i < next.NumField(); i++ {
+		name := next.Type().Field(i).Name
+		if liveFields[name] {
+			current.Field(i).Set(next.Field(i))
+		} else if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			restart = append(restart, name)
+		}
+	}
+
+	g.config, g.acl = &applied, acl
+	g.configLock.Unlock()
+
+	log.SetLevel(level)
+	if g.relay != nil && applied.PublicRelay != previous.PublicRelay {
+		log.WithField("relayHost", applied.PublicRelay).Infoln("Switching to new relay server.")
+		g.relay.SetHost(applied.PublicRelay)
+	}
+	return restart, nil
+}
@@ -0,0 +1,127 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+const (
+	DefaultClockSkew      = 30 * time.Second
+	DefaultNonceCacheSize = 1024
+)
+
+var (
+	ErrMissingNonce    = errors.New("Request has no timestamp or nonce.")
+	ErrStaleRequest    = errors.New("Request timestamp is outside of the allowed clock skew.")
+	ErrReplayedRequest = errors.New("Request has already been received.")
+	ErrNonceCacheFull  = errors.New("Too many recent requests to remember another nonce.")
+)
+
+// ReplayGuard rejects requests whose timestamp is too far from igor's clock and requests whose nonce
+// has already been seen.  A nonce is only forgotten once its timestamp falls outside the clock skew
+// window, after that the request is rejected by its timestamp anyway.  While the cache is full of
+// nonces that are still valid new requests are rejected.
+type ReplayGuard struct {
+	lock     sync.Mutex
+	skew     time.Duration
+	capacity int
+	seen     map[string]time.Time
+	order    []string
+}
+
+func NewReplayGuard(skew time.Duration, capacity int) *ReplayGuard {
+	if skew <= 0 {
+		skew = DefaultClockSkew
+	}
+	if capacity <= 0 {
+		capacity = DefaultNonceCacheSize
+	}
+
+	return &ReplayGuard{skew: skew, capacity: capacity, seen: make(map[string]time.Time, capacity)}
+}
+
+// Check records the nonce of req from sender and returns an error if req should not be processed.
+func (g *ReplayGuard) Check(sender string, req *models.Request) error {
+	if req.Nonce == "" || req.Timestamp.IsZero() {
+		return ErrMissingNonce
+	}
+
+	if !g.Fresh(req.Timestamp) {
+		return ErrStaleRequest
+	}
+	now := time.Now()
+
+	key := sender + "/" + req.Nonce
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, seen := g.seen[key]; seen {
+		return ErrReplayedRequest
+	}
+
+	g.expire(now)
+	if len(g.order) >= g.capacity {
+		return ErrNonceCacheFull
+	}
+
+	g.seen[key] = req.Timestamp
+	g.order = append(g.order, key)
+	return nil
+}
+
+// Fresh reports whether t is within the allowed clock skew of igor's clock.
+func (g *ReplayGuard) Fresh(t time.Time) bool {
+	now := time.Now()
+	return !t.Before(now.Add(-g.skew)) && !t.After(now.Add(g.skew))
+}
+
+// expire forgets the nonces of requests that could no longer pass the timestamp check.  Nonces are
+// kept in the order they arrived rather than by timestamp, so the whole cache is only swept once it
+// is full.
+func (g *ReplayGuard) expire(now time.Time) {
+	cutoff := now.Add(-g.skew)
+
+	if len(g.order) < g.capacity {
+		expired := 0
+		for _, key := range g.order {
+			if !g.seen[key].Before(cutoff) {
+				break
+			}
+			delete(g.seen, key)
+			expired++
+		}
+		g.order = g.order[expired:]
+		return
+	}
+
+	kept := make([]string, 0, len(g.order))
+	for _, key := range g.order {
+		if g.seen[key].Before(cutoff) {
+			delete(g.seen, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	g.order = kept
+}
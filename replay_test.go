@@ -0,0 +1,70 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alittlebrighter/igor/models"
+)
+
+func TestReplayGuard(t *testing.T) {
+	guard := NewReplayGuard(time.Minute, 3)
+	now := time.Now()
+
+	// the cases run in order against the same guard
+	for _, test := range []struct {
+		name, sender, nonce string
+		timestamp           time.Time
+		err                 error
+	}{
+		{"missing nonce", "a", "", now, ErrMissingNonce},
+		{"missing timestamp", "a", "n0", time.Time{}, ErrMissingNonce},
+		{"too old", "a", "n0", now.Add(-2 * time.Minute), ErrStaleRequest},
+		{"too far ahead", "a", "n0", now.Add(2 * time.Minute), ErrStaleRequest},
+		{"fresh", "a", "n1", now, nil},
+		{"replayed", "a", "n1", now, ErrReplayedRequest},
+		{"same nonce from another sender", "b", "n1", now, nil},
+		{"old but within the skew", "a", "n2", now.Add(-50 * time.Second), nil},
+		{"cache full of valid nonces", "a", "n3", now, ErrNonceCacheFull},
+		{"still replayed while full", "a", "n1", now, ErrReplayedRequest},
+	} {
+		req := &models.Request{Nonce: test.nonce, Timestamp: test.timestamp}
+		if err := guard.Check(test.sender, req); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReplayGuardForgetsExpiredNonces(t *testing.T) {
+	skew := 100 * time.Millisecond
+	guard := NewReplayGuard(skew, 1)
+
+	if err := guard.Check("a", &models.Request{Nonce: "n1", Timestamp: time.Now().Add(-skew + 20*time.Millisecond)}); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if err := guard.Check("a", &models.Request{Nonce: "n2", Timestamp: time.Now()}); err != ErrNonceCacheFull {
+		t.Fatalf("Got %v while the first nonce is valid, want %v", err, ErrNonceCacheFull)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if err := guard.Check("a", &models.Request{Nonce: "n2", Timestamp: time.Now()}); err != nil {
+		t.Errorf("Got %v once the first nonce expired, want nil", err)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Igor, a home automation solution
+Copyright (C) 2016  Adam Bright
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package igor
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/alittlebrighter/switchboard-client/security"
+	sModels "github.com/alittlebrighter/switchboard/models"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	ErrUnknownSender = errors.New("Sender is not approved.")
+	ErrBadSignature  = errors.New("Signature could not be verified.")
+)
+
+// SenderRegistry holds the public keys of the clients that are approved to send requests to igor.
+type SenderRegistry struct {
+	lock sync.RWMutex
+	keys map[uuid.UUID]*ecdsa.PublicKey
+}
+
+func NewSenderRegistry() *SenderRegistry {
+	return &SenderRegistry{keys: make(map[uuid.UUID]*ecdsa.PublicKey)}
+}
+
+// LoadSenderRegistry reads a JSON file mapping client IDs to their base64 encoded (PKIX, ASN.1 DER)
+// ECDSA public keys.
+func LoadSenderRegistry(filename string) (*SenderRegistry, error) {
+	registry := NewSenderRegistry()
+	if filename == "" {
+		return registry, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := make(map[string]string)
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+
+	for rawID, rawKey := range encoded {
+		id, err := uuid.FromString(rawID)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ParsePublicKey(rawKey)
+		if err != nil {
+			return nil, err
+		}
+
+		registry.Approve(id, key)
+	}
+
+	return registry, nil
+}
+
+func (r *SenderRegistry) Approve(id uuid.UUID, key *ecdsa.PublicKey) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys[id] = key
+}
+
+func (r *SenderRegistry) Revoke(id uuid.UUID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.keys, id)
+}
+
+func (r *SenderRegistry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.keys)
+}
+
+// List returns the IDs of every approved sender.
+func (r *SenderRegistry) List() []uuid.UUID {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ids := make([]uuid.UUID, 0, len(r.keys))
+	for id := range r.keys {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Verify checks that env was signed by the key registered for env.From.
+func (r *SenderRegistry) Verify(env *sModels.Envelope) error {
+	return r.VerifySignature(env.From, env.Contents, env.Signature)
+}
+
+// VerifySignature checks that sig is a signature of msg made with the key registered for id.
+func (r *SenderRegistry) VerifySignature(id *uuid.UUID, msg, sig string) error {
+	if id == nil {
+		return ErrUnknownSender
+	}
+
+	r.lock.RLock()
+	key, ok := r.keys[*id]
+	r.lock.RUnlock()
+	if !ok {
+		return ErrUnknownSender
+	}
+
+	verified, err := security.VerifyFromString(key, msg, sig)
+	if err != nil {
+		return err
+	} else if !verified {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 encoded (PKIX, ASN.1 DER) ECDSA public key.
+func ParsePublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an ECDSA key.")
+	}
+	return ecKey, nil
+}
+
+// EncodePublicKey is the inverse of ParsePublicKey.
+func EncodePublicKey(key *ecdsa.PublicKey) (string, error) {
+	data, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}